@@ -0,0 +1,142 @@
+// adapt.go - adaptive concurrency
+//
+// (c) 2022- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package walk
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// The adaptive mode works like TCP congestion control:
+//
+// - every readdir(2) and lstat(2) of a worker yields a latency sample;
+//   we track a short and a long term moving average of the latency per
+//   operation.
+//
+// - once per window (as many samples as there are active workers - our
+//   equivalent of a round trip), we add a worker if the short term latency
+//   is within bounds of the long term one. Otherwise the file system is
+//   queueing our requests and we cut the number of workers by a quarter.
+//
+// - the workers beyond the limit wait their turn in get().
+
+const (
+	// by default, the adaptive mode can grow to this many times the
+	// default number of workers.
+	_AdaptiveFactor int = 4
+
+	// a readdir(2) returns roughly this many entries per syscall
+	_DirentsPerCall int = 128
+)
+
+// limiter bounds the number of active workers to a limit that
+// adapts to the observed latency.
+type limiter struct {
+	sync.Mutex
+	cond *sync.Cond
+
+	active int
+	limit  int
+	max    int
+
+	// short and long term moving average of the latency per op
+	short time.Duration
+	long  time.Duration
+
+	// number of samples in this window
+	n int
+}
+
+func newLimiter(ctx context.Context, start, max int) *limiter {
+	l := &limiter{
+		limit: min(start, max),
+		max:   max,
+	}
+	l.cond = sync.NewCond(&l.Mutex)
+
+	// wake up the waiters when we're cancelled
+	context.AfterFunc(ctx, func() {
+		l.Lock()
+		l.cond.Broadcast()
+		l.Unlock()
+	})
+	return l
+}
+
+// wait for our turn to be an active worker; return false if the walk
+// is cancelled. A nil limiter doesn't limit anything.
+func (l *limiter) get(ctx context.Context) bool {
+	if l == nil {
+		return ctx.Err() == nil
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	for l.active >= l.limit && ctx.Err() == nil {
+		l.cond.Wait()
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+	l.active++
+	return true
+}
+
+// an active worker is done
+func (l *limiter) put() {
+	if l == nil {
+		return
+	}
+
+	l.Lock()
+	l.active--
+	l.cond.Signal()
+	l.Unlock()
+}
+
+// record a sample of 'ops' operations that took 'dur'
+func (l *limiter) sample(dur time.Duration, ops int) {
+	if l == nil {
+		return
+	}
+
+	lat := dur / time.Duration(max(ops, 1))
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.long == 0 {
+		l.short, l.long = lat, lat
+	} else {
+		l.short += (lat - l.short) / 8
+		l.long += (lat - l.long) / 128
+	}
+
+	if l.n++; l.n < l.limit {
+		return
+	}
+	l.n = 0
+
+	// allow for some jitter before we call it congestion
+	if l.short > 2*l.long {
+		l.limit = max(l.limit*3/4, 1)
+		return
+	}
+
+	if l.limit < l.max {
+		l.limit++
+		l.cond.Signal()
+	}
+}
@@ -0,0 +1,69 @@
+// adapt_test.go -- tests for adaptive concurrency
+
+package walk
+
+import (
+	"io/fs"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// slowFS is a file system whose latency grows with the number of
+// concurrent reads beyond 'knee'
+type slowFS struct {
+	busyFS
+	knee int64
+}
+
+func (f *slowFS) ReadDir(nm string) ([]fs.DirEntry, error) {
+	n := f.n.Add(1)
+	defer f.n.Add(-1)
+
+	for {
+		m := f.max.Load()
+		if n <= m || f.max.CompareAndSwap(m, n) {
+			break
+		}
+	}
+
+	d := time.Millisecond
+	if n > f.knee {
+		d *= time.Duration((n - f.knee) * 10)
+	}
+	time.Sleep(d)
+	return f.FileSystem.ReadDir(nm)
+}
+
+func TestAdaptive(t *testing.T) {
+	assert := newAsserter(t)
+
+	root := t.TempDir()
+	mkTree(t, root, 3, 7)
+
+	exp, err := oldWalk(&test{root, ALL})
+	assert(err == nil, "oldwalk: %s", err)
+
+	walk := func(fsys FileSystem) {
+		opt := &Options{
+			Type:       ALL,
+			Workers:    64,
+			Adaptive:   true,
+			FileSystem: fsys,
+		}
+
+		_, errs := allWalk(root, opt, exp)
+		assert(len(errs) == 0, "walk: %v", errs)
+	}
+
+	// a file system that scales lets us grow
+	fast := &slowFS{busyFS: busyFS{FileSystem: HostFS()}, knee: 1 << 20}
+	walk(fast)
+	start := int64(runtime.GOMAXPROCS(0) * _ParallelismFactor)
+	assert(fast.max.Load() > start, "didn't grow past %d: %d", start, fast.max.Load())
+
+	// one that doesn't holds us back
+	slow := &slowFS{busyFS: busyFS{FileSystem: HostFS()}, knee: 4}
+	walk(slow)
+	assert(slow.max.Load() < 64, "didn't back off: %d", slow.max.Load())
+}
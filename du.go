@@ -0,0 +1,46 @@
+// du.go - disk usage of a file system tree
+//
+// (c) 2022- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package walk
+
+import (
+	"sync"
+)
+
+// DiskUsage concurrently walks the entries in 'names' and returns the
+// summary of every dir walked - keyed by the path of the dir. The summary
+// of a dir includes its entire subtree; hardlinked files are counted once
+// across the walk. Options.Type, Options.Sorted and Options.OnDirDone
+// are ignored.
+func DiskUsage(names []string, opt *Options) (map[string]DirSummary, error) {
+	var o Options
+	if opt != nil {
+		o = *opt
+	}
+
+	var mu sync.Mutex
+	du := make(map[string]DirSummary)
+
+	o.Type = 0
+	o.Sorted = false
+	o.OnDirDone = func(dir string, s DirSummary) {
+		mu.Lock()
+		du[dir] = s
+		mu.Unlock()
+	}
+
+	err := WalkFunc(names, &o, func(Result) error {
+		return nil
+	})
+	return du, err
+}
@@ -0,0 +1,65 @@
+// du_test.go -- tests for disk usage
+
+package walk
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestDiskUsage(t *testing.T) {
+	assert := newAsserter(t)
+
+	root := t.TempDir()
+	mkTree(t, root, 2, 3)
+
+	big := filepath.Join(root, "dir-0", "big")
+	err := os.WriteFile(big, make([]byte, 1<<20), 0600)
+	assert(err == nil, "write: %s", err)
+
+	// a hardlink in another dir must only be counted once
+	err = os.Link(big, filepath.Join(root, "dir-1", "big-link"))
+	assert(err == nil, "link: %s", err)
+
+	var size, blocks int64
+	var inodes, files int
+	err = filepath.WalkDir(root, func(p string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if filepath.Base(p) == "big-link" {
+			files++
+			return nil
+		}
+
+		fi, err := de.Info()
+		assert(err == nil, "info: %s", err)
+
+		inodes++
+		blocks += fi.Sys().(*syscall.Stat_t).Blocks
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+			files++
+		}
+		return nil
+	})
+	assert(err == nil, "walkdir: %s", err)
+
+	du, err := DiskUsage([]string{root}, nil)
+	assert(err == nil, "du: %s", err)
+	assert(len(du) == 13, "exp 13 dirs, saw %d", len(du))
+
+	s, ok := du[root]
+	assert(ok, "missing root")
+	assert(s.Size == size, "size: exp %d, saw %d", size, s.Size)
+	assert(s.Blocks == blocks, "blocks: exp %d, saw %d", blocks, s.Blocks)
+	assert(s.Inodes == inodes, "inodes: exp %d, saw %d", inodes, s.Inodes)
+	assert(s.Files == files, "files: exp %d, saw %d", files, s.Files)
+
+	d0 := du[filepath.Join(root, "dir-0")]
+	d1 := du[filepath.Join(root, "dir-1")]
+	assert(d0.Size+d1.Size < 2<<20, "hardlink counted twice: %d, %d", d0.Size, d1.Size)
+}
@@ -0,0 +1,73 @@
+// errors.go - errors reported by go-walk
+//
+// (c) 2022- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package walk
+
+import (
+	"fmt"
+	"io/fs"
+)
+
+// Action is the response of the Options.OnError callback to an error
+type Action int
+
+const (
+	// ActionContinue reports the error and continues the walk
+	ActionContinue Action = iota
+
+	// ActionSkipDir silently skips the entry (and its subtree, if it
+	// is a dir) that caused the error; the error is not reported.
+	ActionSkipDir
+
+	// ActionAbort reports the error and stops the walk
+	ActionAbort
+)
+
+// Error records a failed file system operation during the walk. All the
+// file system errors encountered by the walker are reported as an *Error;
+// callers can use errors.Is() and errors.As() to examine the underlying
+// error.
+type Error struct {
+	// Op is the operation that failed; one of "lstat", "stat",
+	// "statx", "readdir", "readlink", "symlink", "getxattr" or "glob".
+	Op string
+
+	// Path is the entry for which the operation failed
+	Path string
+
+	// Root is the entry passed to Walk() that led to Path
+	Root string
+
+	// Err is the underlying error
+	Err error
+}
+
+func (e *Error) Error() string {
+	// don't repeat the path if the underlying error already has it
+	var msg any = e.Err
+	switch err := e.Err.(type) {
+	case *fs.PathError:
+		if err.Path == e.Path {
+			msg = err.Err
+		}
+	case *SymlinkLoopError:
+		if err.Path == e.Path {
+			msg = err.msg()
+		}
+	}
+	return fmt.Sprintf("%s %s: %s", e.Op, e.Path, msg)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,307 @@
+// fdwalk_linux.go - fd relative traversal for linux
+//
+// (c) 2022- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build linux
+
+package walk
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Default max number of dir fds we keep open for pending subdirs
+const _MaxFds int = 256
+
+// flags for opening a dir we are about to read
+const _OpenDir = unix.O_RDONLY | unix.O_DIRECTORY | unix.O_NOFOLLOW | unix.O_CLOEXEC
+
+// fdWalker walks dirs relative to an open fd of their parent dir: subdirs
+// are opened with openat(2) and entries are stat'd with fstatat(2). We never
+// resolve the full path of an entry; so a parent dir that is renamed or
+// replaced by a symlink mid-walk can't redirect us.
+type fdWalker struct {
+	// budget of dir fds we keep open for pending subdirs
+	fds chan struct{}
+}
+
+func newFdWalker(max int) *fdWalker {
+	if max <= 0 {
+		max = _MaxFds
+	}
+	return &fdWalker{
+		fds: make(chan struct{}, max),
+	}
+}
+
+// return the lstat info of dir 'e'
+func (w *fdWalker) lstat(e *entry) (os.FileInfo, error) {
+	if e.dh != nil {
+		return e.dh.fstatat(e.de.Name(), unix.AT_SYMLINK_NOFOLLOW)
+	}
+	return os.Lstat(e.path())
+}
+
+// read the target of the symlink 'e'; relative to its dir if we still
+// have it open.
+func (w *fdWalker) readlink(e *entry) (string, error) {
+	if fe, ok := e.de.(*fdEntry); ok && fe.h.get() {
+		defer fe.h.put()
+		return fe.h.readlinkat(fe.Name())
+	}
+	return os.Readlink(e.path())
+}
+
+// return the info of the target of the symlink 'e'; relative to its dir
+// if we still have it open.
+func (w *fdWalker) stat(e *entry) (os.FileInfo, error) {
+	if fe, ok := e.de.(*fdEntry); ok && fe.h.get() {
+		defer fe.h.put()
+		return fe.h.fstatat(fe.Name(), 0)
+	}
+	return os.Stat(e.path())
+}
+
+// open dir 'e' for reading. If we're out of fds, a dir isn't shared with
+// its subdirs; they are opened by their path and checked against what we
+// saw in the dir.
+func (w *fdWalker) openDir(e *entry) (*dirHandle, error) {
+	var fd int
+	var err error
+
+	if e.dh != nil {
+		fd, err = unix.Openat(e.dh.fd, e.de.Name(), _OpenDir, 0)
+	} else {
+		fd, err = unix.Open(e.path(), _OpenDir, 0)
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: e.path(), Err: err}
+	}
+
+	if e.dh == nil && e.want != nil {
+		var st unix.Stat_t
+		if err = unix.Fstat(fd, &st); err == nil && (uint64(st.Dev) != e.want.Dev || uint64(st.Ino) != e.want.Ino) {
+			err = errors.New("dir replaced during walk")
+		}
+		if err != nil {
+			unix.Close(fd)
+			return nil, &os.PathError{Op: "open", Path: e.path(), Err: err}
+		}
+	}
+
+	h := &dirHandle{
+		f:  os.NewFile(uintptr(fd), e.path()),
+		fd: fd,
+		w:  w,
+	}
+	h.refs.Store(1)
+
+	select {
+	case w.fds <- struct{}{}:
+		h.shared = true
+	default:
+	}
+	return h, nil
+}
+
+// dirHandle is an open dir. It is shared with its subdirs that are yet
+// to be walked and is closed when the last of them is done.
+type dirHandle struct {
+	f  *os.File
+	fd int
+	w  *fdWalker
+
+	refs atomic.Int32
+
+	// set if we hold a slot in the fd budget
+	shared bool
+}
+
+var _ dirFile = &dirHandle{}
+
+func (h *dirHandle) ReadDir(n int) ([]fs.DirEntry, error) {
+	dev, err := h.f.ReadDir(n)
+	for i := range dev {
+		dev[i] = &fdEntry{dev[i], h}
+	}
+	return dev, err
+}
+
+func (h *dirHandle) Close() error {
+	h.put()
+	return nil
+}
+
+// hand this dir to its subdir 'e'; 'fi' is the info of 'e' if we have it.
+func (h *dirHandle) child(e *entry, fi os.FileInfo) {
+	if h.shared {
+		h.refs.Add(1)
+		e.dh = h
+		return
+	}
+
+	// remember what 'e' is so that we can check it when we open it
+	// by its path
+	if fi == nil {
+		var err error
+		if fi, err = h.fstatat(e.de.Name(), unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return
+		}
+	}
+	if id, ok := statID(fi); ok {
+		e.want = &id
+	}
+}
+
+// take a ref if the dir is still open
+func (h *dirHandle) get() bool {
+	for {
+		n := h.refs.Load()
+		if n == 0 {
+			return false
+		}
+		if h.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// drop a ref and close the dir with the last one
+func (h *dirHandle) put() {
+	if h.refs.Add(-1) == 0 {
+		h.f.Close()
+		if h.shared {
+			<-h.w.fds
+		}
+	}
+}
+
+// stat the entry 'nm' of this dir; 'flags' are the AT_* flags of fstatat(2)
+func (h *dirHandle) fstatat(nm string, flags int) (os.FileInfo, error) {
+	fi := &fileInfo{name: nm}
+	st := (*unix.Stat_t)(unsafe.Pointer(&fi.st))
+	if err := unix.Fstatat(h.fd, nm, st, flags); err != nil {
+		op := "stat"
+		if flags&unix.AT_SYMLINK_NOFOLLOW != 0 {
+			op = "lstat"
+		}
+		return nil, &os.PathError{Op: op, Path: path.Join(h.f.Name(), nm), Err: err}
+	}
+	return fi, nil
+}
+
+// read the target of the symlink 'nm' in this dir; like os.Readlink()
+func (h *dirHandle) readlinkat(nm string) (string, error) {
+	for n := 128; ; n *= 2 {
+		b := make([]byte, n)
+		k, err := unix.Readlinkat(h.fd, nm, b)
+		if err != nil {
+			return "", &os.PathError{Op: "readlink", Path: path.Join(h.f.Name(), nm), Err: err}
+		}
+		if k < n {
+			return string(b[:k]), nil
+		}
+	}
+}
+
+// fdEntry is a dir entry that is stat'd relative to its dir
+type fdEntry struct {
+	fs.DirEntry
+	h *dirHandle
+}
+
+func (e *fdEntry) Info() (fs.FileInfo, error) {
+	// the dir is closed once the walk is done with it; we're left
+	// with its path.
+	if !e.h.get() {
+		return e.DirEntry.Info()
+	}
+	defer e.h.put()
+	return e.h.fstatat(e.Name(), unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// fileInfo is the os.FileInfo for an entry we fstatat(2). Its Sys() is
+// a *syscall.Stat_t - like the info from os.Lstat(). The stdlib doesn't
+// have fstatat(2) on every platform; so we use x/sys to fill it. Both
+// describe the same kernel struct.
+type fileInfo struct {
+	name string
+	st   syscall.Stat_t
+}
+
+// the two Stat_t must be the same size
+var _ [unsafe.Sizeof(syscall.Stat_t{}) - unsafe.Sizeof(unix.Stat_t{})]byte
+var _ [unsafe.Sizeof(unix.Stat_t{}) - unsafe.Sizeof(syscall.Stat_t{})]byte
+
+var _ fs.FileInfo = &fileInfo{}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.st.Size
+}
+
+func (fi *fileInfo) Mode() fs.FileMode {
+	return fileMode(uint32(fi.st.Mode))
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	return time.Unix(fi.st.Mtim.Unix())
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.Mode().IsDir()
+}
+
+func (fi *fileInfo) Sys() any {
+	return &fi.st
+}
+
+// convert the unix mode bits to fs.FileMode; like the os package
+func fileMode(m uint32) fs.FileMode {
+	mode := fs.FileMode(m & 0777)
+	switch m & unix.S_IFMT {
+	case unix.S_IFBLK:
+		mode |= fs.ModeDevice
+	case unix.S_IFCHR:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case unix.S_IFDIR:
+		mode |= fs.ModeDir
+	case unix.S_IFIFO:
+		mode |= fs.ModeNamedPipe
+	case unix.S_IFLNK:
+		mode |= fs.ModeSymlink
+	case unix.S_IFSOCK:
+		mode |= fs.ModeSocket
+	}
+	if m&unix.S_ISUID != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if m&unix.S_ISGID != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if m&unix.S_ISVTX != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
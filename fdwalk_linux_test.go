@@ -0,0 +1,98 @@
+// fdwalk_linux_test.go -- tests for the fd relative walk
+
+//go:build linux
+
+package walk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestFdRelative(t *testing.T) {
+	assert := newAsserter(t)
+
+	root := t.TempDir()
+	mkTree(t, root, 4, 3)
+
+	lnk := filepath.Join(root, "dir-0", "link")
+	err := os.Symlink("../file-0", lnk)
+	assert(err == nil, "symlink: %s", err)
+
+	exp, err := oldWalk(&test{root, ALL})
+	assert(err == nil, "oldwalk: %s", err)
+
+	nfds := func() int {
+		des, err := os.ReadDir("/proc/self/fd")
+		assert(err == nil, "readdir: %s", err)
+		return len(des)
+	}
+
+	tests := []Options{
+		{},
+		{MaxFds: 1},
+		{Sorted: true},
+		{Sorted: true, MaxFds: 2},
+		{LazyStat: true},
+		{ReadLinks: true},
+		{FileSystem: HostFS()},
+	}
+
+	before := nfds()
+	for i := range tests {
+		opt := tests[i]
+		opt.Type = ALL
+		opt.FdRelative = true
+
+		n := 0
+		for r, err := range All([]string{root}, &opt) {
+			assert(err == nil, "%d: walk: %s", i, err)
+
+			fi, err := r.Info()
+			assert(err == nil, "%d: info: %s", i, err)
+
+			xi, ok := exp[r.Path]
+			assert(ok, "%d: unexpected entry %s", i, r.Path)
+			assert(fi.Mode() == xi.Mode(), "%d: %s: mode %s, exp %s", i, r.Path, fi.Mode(), xi.Mode())
+			assert(fi.IsDir() || fi.Size() == xi.Size(), "%d: %s: size %d, exp %d", i, r.Path, fi.Size(), xi.Size())
+
+			// the mode doesn't change what callers see
+			_, ok = fi.Sys().(*syscall.Stat_t)
+			assert(ok, "%d: %s: wrong stat type %T", i, r.Path, fi.Sys())
+
+			if opt.ReadLinks && r.Path == lnk {
+				assert(r.LinkTarget == "../file-0" && !r.Dangling, "%d: %s: wrong target %q", i, r.Path, r.LinkTarget)
+			}
+			n++
+		}
+		assert(n == len(exp), "%d: exp %d entries, saw %d", i, len(exp), n)
+		assert(nfds() == before, "%d: leaked fds: %d, exp %d", i, nfds(), before)
+	}
+
+	// walking away mustn't leak fds either
+	for _, sorted := range []bool{false, true} {
+		opt := &Options{
+			Type:       ALL,
+			Sorted:     sorted,
+			FdRelative: true,
+		}
+		for range All([]string{root}, opt) {
+			break
+		}
+		assert(nfds() == before, "sorted %v: leaked fds: %d, exp %d", sorted, nfds(), before)
+	}
+
+	// the host file system is the host file system; however we get it
+	ws := newWalkState(context.Background(), &Options{FdRelative: true, FileSystem: HostFS()})
+	ws.cancel()
+	assert(ws.fdw != nil, "not fd relative with HostFS()")
+
+	// a dir opened by its path must be the dir we saw in its parent
+	w := newFdWalker(1)
+	e := &entry{nm: filepath.Join(root, "dir-1"), want: &FileID{1, 1}}
+	_, err = w.openDir(e)
+	assert(err != nil, "opened a replaced dir")
+}
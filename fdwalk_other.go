@@ -0,0 +1,60 @@
+// fdwalk_other.go - fd relative traversal stubs for non-linux platforms
+//
+// (c) 2022- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !linux
+
+package walk
+
+import (
+	"io/fs"
+	"os"
+)
+
+// the fd relative walk is only supported on linux
+type fdWalker struct{}
+
+func newFdWalker(max int) *fdWalker {
+	return nil
+}
+
+func (w *fdWalker) lstat(e *entry) (os.FileInfo, error) {
+	return os.Lstat(e.path())
+}
+
+func (w *fdWalker) readlink(e *entry) (string, error) {
+	return os.Readlink(e.path())
+}
+
+func (w *fdWalker) stat(e *entry) (os.FileInfo, error) {
+	return os.Stat(e.path())
+}
+
+func (w *fdWalker) openDir(e *entry) (*dirHandle, error) {
+	return nil, fs.ErrInvalid
+}
+
+type dirHandle struct{}
+
+func (h *dirHandle) ReadDir(n int) ([]fs.DirEntry, error) {
+	return nil, fs.ErrInvalid
+}
+
+func (h *dirHandle) Close() error {
+	return nil
+}
+
+func (h *dirHandle) child(e *entry, fi os.FileInfo) {
+}
+
+func (h *dirHandle) put() {
+}
@@ -0,0 +1,208 @@
+// fs.go - file system backends for go-walk
+//
+// (c) 2022- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package walk
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// FileSystem abstracts the file system operations needed by the walker.
+// Every file system access made by the walker goes through this interface;
+// a caller can set Options.FileSystem to walk an in-memory file system,
+// inject faults or to serve a remote file system.
+//
+// Paths are slash separated; the walker makes the path of a directory entry
+// by joining the directory and the entry name with a "/".
+type FileSystem interface {
+	// Lstat returns the info for 'nm' without following symlinks
+	Lstat(nm string) (fs.FileInfo, error)
+
+	// Stat returns the info for 'nm' after following symlinks
+	Stat(nm string) (fs.FileInfo, error)
+
+	// ReadDir returns the entries of the directory 'nm' in any order
+	ReadDir(nm string) ([]fs.DirEntry, error)
+
+	// Readlink returns the target of the symlink 'nm'
+	Readlink(nm string) (string, error)
+
+	// Getxattr returns the extended attributes of 'nm'
+	Getxattr(nm string) (Xattr, error)
+
+	// FileID returns the identity of the file described by 'fi'. It
+	// returns false if the file system doesn't have such a notion; this
+	// disables loop detection and mount point tracking.
+	FileID(fi fs.FileInfo) (FileID, bool)
+}
+
+// FileID uniquely identifies a file system entry
+type FileID struct {
+	Dev uint64 // device holding the entry
+	Ino uint64 // inode number within the device
+}
+
+// HostFS returns the FileSystem backed by the host OS. This is the
+// default file system for a walk.
+func HostFS() FileSystem {
+	return osFS{}
+}
+
+// FromFS returns a FileSystem backed by the io/fs file system 'fsys'.
+// Symlinks are only recognized if 'fsys' implements ReadLink() and Lstat()
+// like os.DirFS. Xattrs are always empty.
+func FromFS(fsys fs.FS) FileSystem {
+	return &ioFS{fsys}
+}
+
+// joiner is implemented by file systems that have their own
+// conventions for making a path from a dir and a name.
+type joiner interface {
+	Join(dir, nm string) string
+}
+
+// readLinkFS is the optional interface of io/fs file systems that can
+// read symlinks; os.DirFS implements it.
+type readLinkFS interface {
+	fs.FS
+	ReadLink(nm string) (string, error)
+	Lstat(nm string) (fs.FileInfo, error)
+}
+
+// dirOpener is implemented by file systems that can read a dir in
+// batches; this lets us walk huge dirs without reading them whole.
+type dirOpener interface {
+	OpenDir(nm string) (dirFile, error)
+}
+
+// dirFile is an open dir that returns at most 'n' entries per call
+// to ReadDir() and io.EOF at the end; like os.File.
+type dirFile interface {
+	ReadDir(n int) ([]fs.DirEntry, error)
+	Close() error
+}
+
+// osFS is the host file system
+type osFS struct{}
+
+var _ FileSystem = osFS{}
+
+func (osFS) Lstat(nm string) (fs.FileInfo, error) {
+	return os.Lstat(nm)
+}
+
+func (osFS) Stat(nm string) (fs.FileInfo, error) {
+	return os.Stat(nm)
+}
+
+// We don't use os.ReadDir() because it sorts the entries.
+func (osFS) ReadDir(nm string) ([]fs.DirEntry, error) {
+	fd, err := os.Open(nm)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	return fd.ReadDir(-1)
+}
+
+func (osFS) OpenDir(nm string) (dirFile, error) {
+	return os.Open(nm)
+}
+
+func (osFS) Readlink(nm string) (string, error) {
+	return os.Readlink(nm)
+}
+
+func (osFS) Getxattr(nm string) (Xattr, error) {
+	return getxattr(nm)
+}
+
+func (osFS) FileID(fi fs.FileInfo) (FileID, bool) {
+	return statID(fi)
+}
+
+// ioFS adapts an io/fs file system for the walker
+type ioFS struct {
+	fs.FS
+}
+
+var _ FileSystem = &ioFS{}
+
+// Lstat falls back to a Stat() if the underlying fs can't read symlinks
+func (f *ioFS) Lstat(nm string) (fs.FileInfo, error) {
+	if l, ok := f.FS.(readLinkFS); ok {
+		return l.Lstat(nm)
+	}
+	return fs.Stat(f.FS, nm)
+}
+
+func (f *ioFS) Stat(nm string) (fs.FileInfo, error) {
+	return fs.Stat(f.FS, nm)
+}
+
+func (f *ioFS) ReadDir(nm string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(f.FS, nm)
+}
+
+func (f *ioFS) Readlink(nm string) (string, error) {
+	if l, ok := f.FS.(readLinkFS); ok {
+		return l.ReadLink(nm)
+	}
+	return "", &fs.PathError{Op: "readlink", Path: nm, Err: errors.ErrUnsupported}
+}
+
+// io/fs file systems don't have xattr
+func (f *ioFS) Getxattr(nm string) (Xattr, error) {
+	return nil, nil
+}
+
+// io/fs file systems backed by the host (eg os.DirFS) expose the stat
+// info
+func (f *ioFS) FileID(fi fs.FileInfo) (FileID, bool) {
+	return statID(fi)
+}
+
+// io/fs paths are always relative to the root of the file system; and "."
+// is never a prefix of a valid path.
+func (f *ioFS) Join(dir, nm string) string {
+	if dir == "." {
+		return nm
+	}
+	return dir + "/" + nm
+}
+
+// return the file identity from the host stat info
+func statID(fi fs.FileInfo) (FileID, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return FileID{}, false
+	}
+
+	id := FileID{
+		Dev: uint64(st.Dev),
+		Ino: uint64(st.Ino),
+	}
+	return id, true
+}
+
+// return the number of 512 byte blocks allocated to an entry
+func statBlocks(fi fs.FileInfo) int64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int64(st.Blocks)
+	}
+	return 0
+}
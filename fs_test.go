@@ -0,0 +1,302 @@
+// fs_test.go -- tests for walking io/fs file systems
+
+package walk
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"testing/fstest"
+)
+
+func TestWalkFS(t *testing.T) {
+	assert := newAsserter(t)
+
+	mfs := fstest.MapFS{
+		"a/b/c.txt":   {Data: []byte("c")},
+		"a/b/d/e.txt": {Data: []byte("e")},
+		"a/f.txt":     {Data: []byte("f")},
+		"g.txt":       {Data: []byte("g")},
+	}
+
+	exp := make(map[string]bool)
+	err := fs.WalkDir(mfs, ".", func(p string, de fs.DirEntry, err error) error {
+		exp[p] = true
+		return err
+	})
+	assert(err == nil, "walkdir: %s", err)
+
+	seen := walkFS(t, mfs, []string{"."}, &Options{Type: ALL})
+	assert(len(seen) == len(exp), "exp %d entries, saw %d: %v", len(exp), len(seen), seen)
+	for k := range exp {
+		assert(seen[k], "missing %s", k)
+	}
+
+	seen = walkFS(t, mfs, []string{"a/b"}, &Options{Type: FILE})
+	assert(len(seen) == 2, "exp 2 files, saw %v", seen)
+	assert(seen["a/b/d/e.txt"], "missing a/b/d/e.txt")
+
+	// symlinks are followed in DirFS
+	root := t.TempDir()
+	mkTree(t, root, 1, 2)
+	err = os.Symlink("dir-1", filepath.Join(root, "link"))
+	assert(err == nil, "symlink: %s", err)
+
+	seen = walkFS(t, os.DirFS(root), []string{"."}, &Options{Type: FILE | SYMLINK})
+	assert(seen["link"], "missing symlink: %v", seen)
+
+	seen = walkFS(t, os.DirFS(root), []string{"link"}, &Options{Type: FILE, FollowSymlinks: true})
+	assert(seen["dir-1/file-0"], "symlink not followed: %v", seen)
+}
+
+func walkFS(t *testing.T, fsys fs.FS, roots []string, opt *Options) map[string]bool {
+	assert := newAsserter(t)
+
+	och, ech := WalkFS(fsys, roots, opt)
+
+	var errs []error
+	done := make(chan bool)
+	go func() {
+		for err := range ech {
+			errs = append(errs, err)
+		}
+		close(done)
+	}()
+
+	seen := make(map[string]bool)
+	for r := range och {
+		assert(!seen[r.Path], "duplicate entry %s", r.Path)
+		seen[r.Path] = true
+	}
+
+	<-done
+	assert(len(errs) == 0, "walkfs: %v", errs)
+	return seen
+}
+
+// faultFS fails ReadDir() for the given dirs
+type faultFS struct {
+	FileSystem
+	bad map[string]error
+}
+
+func (f *faultFS) ReadDir(nm string) ([]fs.DirEntry, error) {
+	if err, ok := f.bad[nm]; ok {
+		return nil, &fs.PathError{Op: "readdir", Path: nm, Err: err}
+	}
+	return f.FileSystem.ReadDir(nm)
+}
+
+// xattrFS fails Getxattr() for the given entries
+type xattrFS struct {
+	FileSystem
+	bad map[string]error
+}
+
+func (f *xattrFS) Getxattr(nm string) (Xattr, error) {
+	if err, ok := f.bad[nm]; ok {
+		return nil, &fs.PathError{Op: "getxattr", Path: nm, Err: err}
+	}
+	return f.FileSystem.Getxattr(nm)
+}
+
+// statFS counts the dir entries we stat
+type statFS struct {
+	FileSystem
+	n atomic.Int64
+}
+
+type statEntry struct {
+	fs.DirEntry
+	n *atomic.Int64
+}
+
+func (f *statFS) ReadDir(nm string) ([]fs.DirEntry, error) {
+	des, err := f.FileSystem.ReadDir(nm)
+	for i := range des {
+		des[i] = &statEntry{des[i], &f.n}
+	}
+	return des, err
+}
+
+func (e *statEntry) Info() (fs.FileInfo, error) {
+	e.n.Add(1)
+	return e.DirEntry.Info()
+}
+
+func TestLazyStat(t *testing.T) {
+	assert := newAsserter(t)
+
+	root := t.TempDir()
+	mkTree(t, root, 2, 3)
+
+	tests := []struct {
+		typ    Type
+		filter bool
+		exp    int64
+	}{
+		{DIR, false, 0},
+		{FILE, false, 39},
+		{DIR, true, 51},
+	}
+
+	for _, tc := range tests {
+		fsys := &statFS{FileSystem: HostFS()}
+		opt := &Options{
+			Type:       tc.typ,
+			FileSystem: fsys,
+		}
+		if tc.filter {
+			opt.Filter = func(string, fs.FileInfo) bool { return false }
+		}
+
+		n := 0
+		for r, err := range All([]string{root}, opt) {
+			assert(err == nil, "walk: %s", err)
+			assert(r.Stat != nil, "%s: no stat", r.Path)
+			n++
+		}
+		assert(n > 0, "%v: no results", tc.typ)
+		assert(fsys.n.Load() == tc.exp, "%v: exp %d stats, saw %d", tc.typ, tc.exp, fsys.n.Load())
+	}
+
+	// only the files we ask about are stat'd in the LazyStat mode
+	fsys := &statFS{FileSystem: HostFS()}
+	opt := &Options{
+		Type:       FILE,
+		LazyStat:   true,
+		FileSystem: fsys,
+	}
+
+	n := int64(0)
+	for r, err := range All([]string{root}, opt) {
+		assert(err == nil, "walk: %s", err)
+		assert(r.Type().IsRegular(), "%s: wrong type %s", r.Path, r.Type())
+		if n++; n%2 == 0 {
+			continue
+		}
+
+		assert(r.Stat == nil, "%s: stat'd", r.Path)
+		fi, err := r.Info()
+		assert(err == nil, "%s: info: %s", r.Path, err)
+		assert(fi.Mode().IsRegular() && r.Stat == fi, "%s: wrong info", r.Path)
+	}
+	assert(n == 39, "exp 39 files, saw %d", n)
+	assert(fsys.n.Load() == 20, "exp 20 stats, saw %d", fsys.n.Load())
+}
+
+func TestFileSystem(t *testing.T) {
+	assert := newAsserter(t)
+
+	root := t.TempDir()
+	mkTree(t, root, 2, 3)
+
+	bad := filepath.Join(root, "dir-1")
+	opt := &Options{
+		Type:       FILE,
+		FileSystem: &faultFS{HostFS(), map[string]error{bad: fs.ErrPermission}},
+	}
+
+	var errs []error
+	seen := make(map[string]bool)
+	for r, err := range All([]string{root}, opt) {
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		seen[r.Path] = true
+	}
+
+	assert(len(errs) == 1, "exp 1 error, saw %v", errs)
+	assert(errors.Is(errs[0], fs.ErrPermission), "wrong error: %s", errs[0])
+
+	var we *Error
+	assert(errors.As(errs[0], &we), "not a walk error: %s", errs[0])
+	assert(we.Op == "readdir" && we.Path == bad && we.Root == root, "wrong error: %+v", we)
+	assert(seen[filepath.Join(root, "dir-0", "file-0")], "missing entries: %v", seen)
+	for k := range seen {
+		assert(!strings.HasPrefix(k, bad+"/"), "saw entry in failed dir: %s", k)
+	}
+}
+
+func TestOnError(t *testing.T) {
+	assert := newAsserter(t)
+
+	root := t.TempDir()
+	mkTree(t, root, 2, 3)
+
+	perm := filepath.Join(root, "dir-0")
+	eio := filepath.Join(root, "dir-2", "dir-1")
+	opt := &Options{
+		Type: FILE,
+		FileSystem: &faultFS{HostFS(), map[string]error{
+			perm: syscall.EACCES,
+			eio:  syscall.EIO,
+		}},
+	}
+
+	// by default, we see every error
+	var errs []error
+	for _, err := range All([]string{root}, opt) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	assert(len(errs) == 2, "exp 2 errors, saw %v", errs)
+
+	// skip EACCES and abort on EIO
+	var n atomic.Int32
+	opt.OnError = func(err *Error) Action {
+		n.Add(1)
+		switch {
+		case errors.Is(err, fs.ErrPermission):
+			return ActionSkipDir
+		case errors.Is(err, syscall.EIO):
+			return ActionAbort
+		}
+		return ActionContinue
+	}
+
+	err := WalkFunc([]string{root}, opt, func(r Result) error {
+		return nil
+	})
+	assert(n.Load() >= 1, "OnError not called")
+	assert(errors.Is(err, syscall.EIO), "exp EIO, saw %v", err)
+	assert(!errors.Is(err, syscall.EACCES), "saw EACCES: %v", err)
+
+	// and just skip the errors
+	opt.OnError = func(err *Error) Action {
+		return ActionSkipDir
+	}
+	err = WalkFunc([]string{root}, opt, func(r Result) error {
+		return nil
+	})
+	assert(err == nil, "exp no errors, saw %v", err)
+
+	// a dir we can't return is skipped along with its subtree
+	bad := filepath.Join(root, "dir-1")
+	for _, sorted := range []bool{false, true} {
+		opt := &Options{
+			Type:       ALL,
+			Xattr:      true,
+			Sorted:     sorted,
+			FileSystem: &xattrFS{HostFS(), map[string]error{bad: syscall.EIO}},
+			OnError: func(err *Error) Action {
+				return ActionSkipDir
+			},
+		}
+
+		n := 0
+		for r, err := range All([]string{root}, opt) {
+			assert(err == nil, "sorted %v: unexpected error: %s", sorted, err)
+			assert(r.Path != bad && !strings.HasPrefix(r.Path, bad+"/"), "sorted %v: saw %s", sorted, r.Path)
+			n++
+		}
+		assert(n == 36, "sorted %v: exp 36 entries, saw %d", sorted, n)
+	}
+}
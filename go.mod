@@ -1,5 +1,5 @@
 module github.com/opencoff/go-walk
 
-go 1.20
+go 1.23
 
 require golang.org/x/sys v0.14.0
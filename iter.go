@@ -0,0 +1,54 @@
+// iter.go - range-over-func iterators for go-walk
+//
+// (c) 2022- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package walk
+
+import (
+	"context"
+	"iter"
+)
+
+// All traverses the entries in 'names' in a concurrent fashion and returns
+// an iterator over the results. Errors encountered during the walk are
+// yielded with a Result that only has Path, Root and Err set. Breaking
+// out of the loop stops the walk and releases all the workers:
+//
+//	for r, err := range walk.All(names, &opt) {
+//		...
+//	}
+func All(names []string, opt *Options) iter.Seq2[Result, error] {
+	return AllContext(context.Background(), names, opt)
+}
+
+// AllContext is like All except the traversal is aborted when 'ctx' is
+// cancelled. In that case, ctx.Err() is yielded as the error.
+func AllContext(ctx context.Context, names []string, opt *Options) iter.Seq2[Result, error] {
+	return func(yield func(Result, error) bool) {
+		d := newWalkState(ctx, opt)
+		d.ErrorsInResult = true
+		och := d.walkChan(ctx, names)
+
+		// stop the walk and wait for the workers to go away
+		defer func() {
+			d.cancel()
+			for range och {
+			}
+		}()
+
+		for r := range och {
+			if !yield(r, r.Err) {
+				return
+			}
+		}
+	}
+}
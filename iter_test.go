@@ -0,0 +1,54 @@
+// iter_test.go -- tests for the iterator API
+
+package walk
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestAll(t *testing.T) {
+	assert := newAsserter(t)
+
+	root := t.TempDir()
+	mkTree(t, root, 3, 5)
+
+	exp, err := walkAll(root, ALL)
+	assert(err == nil, "walk: %s", err)
+
+	seen := make(map[string]bool)
+	for r, err := range All([]string{root}, &Options{Type: ALL}) {
+		assert(err == nil, "iter: %s", err)
+		seen[r.Path] = true
+	}
+	assert(len(seen) == len(exp), "iter: exp %d entries, saw %d", len(exp), len(seen))
+
+	// breaking out of the loop must release all go-routines
+	ngr := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		n := 0
+		for _, err := range All([]string{root}, &Options{Type: ALL}) {
+			assert(err == nil, "iter: %s", err)
+			if n++; n == 3 {
+				break
+			}
+		}
+	}
+
+	for i := 0; i < 100 && runtime.NumGoroutine() > ngr; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert(runtime.NumGoroutine() <= ngr, "leaked go-routines: %d vs %d",
+		runtime.NumGoroutine(), ngr)
+}
+
+// return all the entries of the given type under root
+func walkAll(root string, typ Type) (map[string]bool, error) {
+	r, err := newWalk(&test{root, typ})
+	m := make(map[string]bool)
+	for k := range r {
+		m[k] = true
+	}
+	return m, err
+}
@@ -0,0 +1,31 @@
+// load_linux.go - system load average for linux
+//
+// (c) 2022- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build linux
+
+package walk
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// return the 1 minute load average of the system
+func sysLoadavg() (float64, bool) {
+	var si unix.Sysinfo_t
+	if err := unix.Sysinfo(&si); err != nil {
+		return 0, false
+	}
+
+	// the loads are fixed point numbers with 16 bits of fraction
+	return float64(si.Loads[0]) / (1 << 16), true
+}
@@ -0,0 +1,21 @@
+// load_other.go - system load average for non-linux platforms
+//
+// (c) 2022- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !linux
+
+package walk
+
+// we only know the load average on linux
+func sysLoadavg() (float64, bool) {
+	return 0, false
+}
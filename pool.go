@@ -0,0 +1,62 @@
+// pool.go - worker pool shared by concurrent walks
+//
+// (c) 2022- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package walk
+
+import (
+	"context"
+	"runtime"
+)
+
+// Pool bounds the number of dirs read concurrently by all the walks
+// that share it via Options.Pool. Each walk still has its own workers;
+// a worker waits for its turn in the pool before it reads a dir.
+type Pool struct {
+	sem chan struct{}
+}
+
+// NewPool returns a pool that lets at most 'n' dirs be read at a time.
+// If 'n' is zero, a default of twice runtime.GOMAXPROCS() is used.
+func NewPool(n int) *Pool {
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0) * _ParallelismFactor
+	}
+	return &Pool{
+		sem: make(chan struct{}, n),
+	}
+}
+
+// wait for a turn in the pool; return false if the walk is cancelled.
+// A nil pool doesn't bound anything.
+func (p *Pool) get(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if p == nil {
+		return true
+	}
+
+	select {
+	case p.sem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// give up our turn in the pool
+func (p *Pool) put() {
+	if p != nil {
+		<-p.sem
+	}
+}
@@ -0,0 +1,72 @@
+// pool_test.go -- tests for worker counts and shared pools
+
+package walk
+
+import (
+	"io/fs"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// busyFS tracks the max number of dirs read concurrently
+type busyFS struct {
+	FileSystem
+	n   atomic.Int64
+	max atomic.Int64
+}
+
+func (f *busyFS) ReadDir(nm string) ([]fs.DirEntry, error) {
+	n := f.n.Add(1)
+	defer f.n.Add(-1)
+
+	for {
+		m := f.max.Load()
+		if n <= m || f.max.CompareAndSwap(m, n) {
+			break
+		}
+	}
+
+	time.Sleep(time.Millisecond)
+	return f.FileSystem.ReadDir(nm)
+}
+
+func TestWorkers(t *testing.T) {
+	assert := newAsserter(t)
+
+	root := t.TempDir()
+	mkTree(t, root, 3, 4)
+
+	exp, err := oldWalk(&test{root, ALL})
+	assert(err == nil, "oldwalk: %s", err)
+
+	for _, w := range []int{1, 3, 16} {
+		fsys := &busyFS{FileSystem: HostFS()}
+		opt := &Options{Type: ALL, Workers: w, QueueSize: 1, FileSystem: fsys}
+		_, errs := allWalk(root, opt, exp)
+		assert(len(errs) == 0, "workers %d: %v", w, errs)
+		assert(fsys.max.Load() <= int64(w), "workers %d: saw %d concurrent reads", w, fsys.max.Load())
+	}
+
+	// concurrent walks sharing a pool
+	fsys := &busyFS{FileSystem: HostFS()}
+	pool := NewPool(2)
+
+	var wg sync.WaitGroup
+	errs := make([][]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			opt := &Options{Type: ALL, Workers: 8, Pool: pool, FileSystem: fsys}
+			_, errs[i] = allWalk(root, opt, exp)
+		}()
+	}
+	wg.Wait()
+
+	for i := range errs {
+		assert(len(errs[i]) == 0, "pool walk %d: %v", i, errs[i])
+	}
+	assert(fsys.max.Load() <= 2, "pool: saw %d concurrent reads", fsys.max.Load())
+}
@@ -0,0 +1,83 @@
+// queue.go - queue of dirs waiting for a worker
+//
+// (c) 2022- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package walk
+
+import (
+	"sync"
+)
+
+// workQueue is the unbounded queue of dirs waiting for a worker; adding
+// to it never blocks and its memory is proportional to the pending dirs.
+// The workers pick the most recently added dirs first: this depth first
+// order keeps the number of pending dirs (and of the dirs held open in
+// the FdRelative mode) low.
+type workQueue struct {
+	sync.Mutex
+	cond *sync.Cond
+
+	q      []entry
+	closed bool
+}
+
+func newWorkQueue() *workQueue {
+	w := &workQueue{}
+	w.cond = sync.NewCond(&w.Mutex)
+	return w
+}
+
+// add 'dirs' to the queue
+func (w *workQueue) push(dirs []entry) {
+	w.Lock()
+	w.q = append(w.q, dirs...)
+	w.Unlock()
+
+	if len(dirs) == 1 {
+		w.cond.Signal()
+	} else {
+		w.cond.Broadcast()
+	}
+}
+
+// return the next dir; wait till there is one or the queue is closed
+func (w *workQueue) pop() (entry, bool) {
+	w.Lock()
+	defer w.Unlock()
+
+	for len(w.q) == 0 {
+		if w.closed {
+			return entry{}, false
+		}
+		w.cond.Wait()
+	}
+
+	n := len(w.q) - 1
+	e := w.q[n]
+	w.q[n] = entry{}
+	w.q = w.q[:n]
+
+	// give back the memory of a queue that was once much larger
+	if c := cap(w.q); c > 1024 && n < c/4 {
+		w.q = append(make([]entry, 0, c/2), w.q...)
+	}
+	return e, true
+}
+
+// wake up the workers waiting for a dir; pop() returns false once
+// the queue is empty.
+func (w *workQueue) close() {
+	w.Lock()
+	w.closed = true
+	w.Unlock()
+	w.cond.Broadcast()
+}
@@ -0,0 +1,368 @@
+// sort.go - deterministic ordering of walk results
+//
+// (c) 2022- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package walk
+
+import (
+	"container/heap"
+	"slices"
+	"sync"
+)
+
+// Design of the sorted mode:
+//
+// - every dir is a node in a tree. A worker processing a dir appends its
+//   results to the dir's node - first the dir itself, then its entries in
+//   lexical order. A subdir is a placeholder item pointing to its own node.
+//
+// - a single emitter go-routine does a DFS of the tree: it waits for a
+//   node to be complete and outputs its items in order, descending into
+//   the child nodes as it encounters them.
+//
+// - workers are not fed dirs as they are discovered. Instead, the dirs are
+//   kept in a heap ordered by their position in the DFS and at most
+//   'max' of them are dispatched ahead of the emitter. This bounds the
+//   number of dir listings buffered in memory. The node the emitter is
+//   waiting for is always dispatched right away - so we can never deadlock.
+
+// node states
+const (
+	_Pending   int = iota // discovered, not yet dispatched
+	_Scheduled            // dispatched to a worker
+	_Done                 // worker is done with it
+	_Emitting             // emitter is working on it
+)
+
+// a dir in the sorted mode
+type node struct {
+	e      entry
+	parent *node
+
+	// position of this node in the DFS
+	key []int
+
+	// results and subdirs of this dir in order
+	items []item
+
+	// closed when the worker is done with this dir
+	done chan struct{}
+
+	// post-order state of this dir
+	ds *dirState
+
+	// the rest are protected by sorter's lock
+	kids  []*node
+	state int
+	skip  bool
+}
+
+// a result or a subdir
+type item struct {
+	r     Result
+	child *node
+}
+
+type sorter struct {
+	sync.Mutex
+
+	d *walkState
+
+	// discovered dirs in DFS order
+	pending nodeHeap
+
+	// number of dirs dispatched but not yet emitted
+	inflight int
+	max      int
+
+	// closed when the emitter is done
+	fin chan struct{}
+}
+
+func newSorter(d *walkState) *sorter {
+	s := &sorter{
+		d:   d,
+		max: d.qsize,
+		fin: make(chan struct{}),
+	}
+	return s
+}
+
+// make the root node; its items are the entries passed to Walk()
+func (s *sorter) root() *node {
+	s.inflight++
+	n := &node{
+		done:  make(chan struct{}),
+		state: _Scheduled,
+	}
+	return n
+}
+
+// make a node for the dir 'e' and reserve its place among the items of
+// its parent. Only the worker processing the parent calls this.
+func (s *sorter) newNode(e entry) *node {
+	p := e.n
+	n := &node{
+		parent: p,
+		key:    append(p.key[:len(p.key):len(p.key)], len(p.items)),
+		done:   make(chan struct{}),
+	}
+
+	p.items = append(p.items, item{child: n})
+	e.n = n
+	n.e = e
+	return n
+}
+
+// add newly discovered dirs and return the ones that can be
+// dispatched right away
+func (s *sorter) add(dirs []entry) []entry {
+	s.Lock()
+	defer s.Unlock()
+
+	for i := range dirs {
+		n := dirs[i].n
+		p := n.parent
+
+		p.kids = append(p.kids, n)
+		if p.skip {
+			n.skip = true
+			s.abandon(n)
+			continue
+		}
+		heap.Push(&s.pending, n)
+	}
+	return s.pump()
+}
+
+// a worker is done with 'n'
+func (s *sorter) finish(n *node) {
+	s.Lock()
+	n.state = _Done
+	if n.skip {
+		s.inflight--
+	}
+	close(n.done)
+	dirs := s.pump()
+	s.Unlock()
+
+	s.d.dispatch(dirs)
+}
+
+// a worker is about to process 'n'; return false if we don't need its
+// results. The emitter holds on to 'ds' till it has emitted 'n'; so the
+// totals of a dir the caller skips don't reach its parent.
+func (s *sorter) start(n *node, ds *dirState) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if n.skip {
+		return false
+	}
+	if ds != nil {
+		ds.hold()
+		n.ds = ds
+	}
+	return true
+}
+
+// run the emitter till we're done
+func (s *sorter) run(root *node) {
+	s.emit(root)
+	close(s.fin)
+}
+
+// output the subtree rooted at 'n' in DFS order; return false if
+// the walk is stopped
+func (s *sorter) emit(n *node) bool {
+	if !s.wait(n) {
+		return false
+	}
+
+	d := s.d
+	for i := range n.items {
+		it := &n.items[i]
+		if it.child != nil {
+			if !s.emit(it.child) {
+				return false
+			}
+
+			// the subtree is out; let it go
+			s.Lock()
+			it.child = nil
+			s.Unlock()
+			continue
+		}
+
+		// only the dir's own result can be a dir
+		err := d.apply(it.r)
+		if err == SkipDir && it.r.Type().IsDir() {
+			if n.ds != nil {
+				n.ds.skipped()
+			}
+			s.skipKids(n)
+			break
+		}
+
+		if d.ctx.Err() != nil {
+			return false
+		}
+	}
+
+	if n.ds != nil {
+		d.dirDone(n.ds)
+		d.dirEmitted(n.ds)
+	}
+
+	// we only hold on to the dirs that are yet to be emitted
+	s.Lock()
+	n.items = nil
+	n.kids = nil
+	n.e = entry{}
+	n.ds = nil
+	s.Unlock()
+	return true
+}
+
+// wait for a worker to be done with 'n'
+func (s *sorter) wait(n *node) bool {
+	var dirs []entry
+
+	// we need this now
+	s.Lock()
+	if n.state == _Pending {
+		dirs = append(dirs, s.schedule(n))
+	}
+	s.Unlock()
+	s.d.dispatch(dirs)
+
+	select {
+	case <-n.done:
+	case <-s.d.ctx.Done():
+		return false
+	}
+
+	s.Lock()
+	n.state = _Emitting
+	s.inflight--
+	dirs = s.pump()
+	s.Unlock()
+
+	s.d.dispatch(dirs)
+	return true
+}
+
+// the caller doesn't want the children of 'n'
+func (s *sorter) skipKids(n *node) {
+	s.Lock()
+	for _, k := range n.kids {
+		s.skip(k)
+	}
+	dirs := s.pump()
+	s.Unlock()
+
+	s.d.dispatch(dirs)
+}
+
+// mark 'n' and its descendants as not needed; the caller holds the lock
+func (s *sorter) skip(n *node) {
+	if n.skip {
+		return
+	}
+
+	n.skip = true
+	switch n.state {
+	case _Done:
+		s.inflight--
+	case _Pending:
+		s.abandon(n)
+	}
+
+	// we won't emit it; so let go of it
+	if n.ds != nil {
+		s.d.dirDone(n.ds)
+		n.ds = nil
+	}
+
+	for _, k := range n.kids {
+		s.skip(k)
+	}
+}
+
+// we will never dispatch 'n'; so its parent is no longer waiting for it.
+// The caller holds the lock.
+func (s *sorter) abandon(n *node) {
+	n.e.drop()
+	s.d.dirDone(n.e.ds)
+}
+
+// return the dirs that can be dispatched now; the caller holds the lock
+func (s *sorter) pump() []entry {
+	var dirs []entry
+
+	for s.inflight < s.max && len(s.pending) > 0 {
+		n := heap.Pop(&s.pending).(*node)
+		if n.state != _Pending || n.skip {
+			continue
+		}
+		dirs = append(dirs, s.schedule(n))
+	}
+	return dirs
+}
+
+// mark 'n' as dispatched; the caller holds the lock
+func (s *sorter) schedule(n *node) entry {
+	n.state = _Scheduled
+	s.inflight++
+	return n.e
+}
+
+// drop the dirs we never dispatched; called after the walk is done
+func (s *sorter) drop() {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, n := range s.pending {
+		if n.state == _Pending && !n.skip {
+			n.e.drop()
+		}
+	}
+	s.pending = nil
+}
+
+// nodeHeap orders nodes by their position in the DFS
+type nodeHeap []*node
+
+func (h nodeHeap) Len() int {
+	return len(h)
+}
+
+func (h nodeHeap) Less(i, j int) bool {
+	return slices.Compare(h[i].key, h[j].key) < 0
+}
+
+func (h nodeHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *nodeHeap) Push(x any) {
+	*h = append(*h, x.(*node))
+}
+
+func (h *nodeHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return x
+}
@@ -0,0 +1,102 @@
+// sort_test.go -- tests for the sorted mode
+
+package walk
+
+import (
+	"io/fs"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestSorted(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := t.TempDir()
+	mkTree(t, tmp, 3, 5)
+
+	// walk a couple of roots out of order
+	roots := []string{
+		filepath.Join(tmp, "dir-3"),
+		filepath.Join(tmp, "file-2"),
+		filepath.Join(tmp, "dir-1"),
+	}
+
+	var exp []string
+	for _, nm := range roots {
+		err := filepath.WalkDir(nm, func(p string, de fs.DirEntry, err error) error {
+			exp = append(exp, p)
+			return err
+		})
+		assert(err == nil, "walkdir: %s", err)
+	}
+
+	opt := &Options{
+		Type:   ALL,
+		Sorted: true,
+	}
+
+	var res []string
+	for r, err := range All(roots, opt) {
+		assert(err == nil, "walk: %s", err)
+		res = append(res, r.Path)
+	}
+
+	assert(len(res) == len(exp), "exp %d entries, saw %d", len(exp), len(res))
+	for i := range exp {
+		assert(exp[i] == res[i], "%d: exp %s, saw %s", i, exp[i], res[i])
+	}
+
+	// files only, with a pruned subtree
+	exp = exp[:0]
+	err := filepath.WalkDir(tmp, func(p string, de fs.DirEntry, err error) error {
+		if de.IsDir() && de.Name() == "dir-2" {
+			return filepath.SkipDir
+		}
+		if de.Type().IsRegular() {
+			exp = append(exp, p)
+		}
+		return err
+	})
+	assert(err == nil, "walkdir: %s", err)
+
+	res = res[:0]
+	opt.Type = FILE | DIR
+	err = WalkFunc([]string{tmp}, opt, func(r Result) error {
+		if r.Stat.IsDir() {
+			if filepath.Base(r.Path) == "dir-2" {
+				return SkipDir
+			}
+			return nil
+		}
+
+		// no locking; we're called serially
+		res = append(res, r.Path)
+		return nil
+	})
+	assert(err == nil, "walkfunc: %s", err)
+
+	assert(len(res) == len(exp), "exp %d entries, saw %d", len(exp), len(res))
+	for i := range exp {
+		assert(exp[i] == res[i], "%d: exp %s, saw %s", i, exp[i], res[i])
+	}
+
+	// breaking out early must release all go-routines
+	ngr := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		n := 0
+		for _, err := range All([]string{tmp}, opt) {
+			assert(err == nil, "iter: %s", err)
+			if n++; n == 3 {
+				break
+			}
+		}
+	}
+
+	for i := 0; i < 100 && runtime.NumGoroutine() > ngr; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert(runtime.NumGoroutine() <= ngr, "leaked go-routines: %d vs %d",
+		runtime.NumGoroutine(), ngr)
+}
@@ -0,0 +1,43 @@
+// statx.go - extended stat info
+//
+// (c) 2022- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package walk
+
+import (
+	"time"
+)
+
+// Statx is the extended stat info of an entry as returned by statx(2) on
+// linux. Only the fields named in Mask are valid; the file system may
+// return fewer fields than were asked for via Options.StatxMask.
+type Statx struct {
+	// the unix.STATX_* fields that are valid
+	Mask uint32
+
+	// Btime is the creation (birth) time
+	Btime time.Time
+
+	// MntID is the id of the mount holding the entry
+	MntID uint64
+
+	// Attributes are the unix.STATX_ATTR_* flags of the entry (eg
+	// immutable, append-only, compressed); AttributesMask tells which
+	// of them the file system supports.
+	Attributes     uint64
+	AttributesMask uint64
+
+	// The alignment needed for direct I/O of the memory buffer and the
+	// file offset; zero if direct I/O isn't supported.
+	DioMemAlign    uint32
+	DioOffsetAlign uint32
+}
@@ -0,0 +1,64 @@
+// statx_linux.go - statx(2) support for linux
+//
+// (c) 2022- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build linux
+
+package walk
+
+import (
+	"io/fs"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// return the statx(2) info of 'e'; we do this relative to its dir if we
+// have it open. We only know how to do this for the host file system.
+func (d *walkState) statx(e *entry) (*Statx, error) {
+	if _, ok := d.fsys.(osFS); !ok {
+		return nil, nil
+	}
+
+	dirfd, nm := unix.AT_FDCWD, e.path()
+	switch fe, _ := e.de.(*fdEntry); {
+	case e.dh != nil:
+		dirfd, nm = e.dh.fd, e.de.Name()
+
+	case fe != nil && !(d.FollowSymlinks && fe.Type()&fs.ModeSymlink != 0):
+		// a followed symlink is resolved by its path
+		if fe.h.get() {
+			defer fe.h.put()
+			dirfd, nm = fe.h.fd, fe.Name()
+		}
+	}
+
+	var st unix.Statx_t
+	flags := unix.AT_SYMLINK_NOFOLLOW | unix.AT_STATX_SYNC_AS_STAT
+	if err := unix.Statx(dirfd, nm, flags, int(d.StatxMask), &st); err != nil {
+		return nil, &os.PathError{Op: "statx", Path: e.path(), Err: err}
+	}
+
+	sx := &Statx{
+		Mask:           st.Mask,
+		MntID:          st.Mnt_id,
+		Attributes:     st.Attributes,
+		AttributesMask: st.Attributes_mask,
+		DioMemAlign:    st.Dio_mem_align,
+		DioOffsetAlign: st.Dio_offset_align,
+	}
+	if st.Mask&unix.STATX_BTIME != 0 {
+		sx.Btime = time.Unix(st.Btime.Sec, int64(st.Btime.Nsec))
+	}
+	return sx, nil
+}
@@ -0,0 +1,55 @@
+// statx_linux_test.go -- tests for statx(2) support
+
+//go:build linux
+
+package walk
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestStatx(t *testing.T) {
+	assert := newAsserter(t)
+
+	start := time.Now().Add(-time.Minute)
+	root := t.TempDir()
+	mkTree(t, root, 2, 3)
+
+	for _, fdrel := range []bool{false, true} {
+		opt := &Options{
+			Type:       ALL,
+			StatxMask:  unix.STATX_BTIME | unix.STATX_MNT_ID,
+			FdRelative: fdrel,
+		}
+
+		var mnt uint64
+		n := 0
+		for r, err := range All([]string{root}, opt) {
+			assert(err == nil, "fdrel %v: walk: %s", fdrel, err)
+
+			sx := r.Statx
+			assert(sx != nil, "fdrel %v: %s: no statx", fdrel, r.Path)
+			assert(sx.Mask&unix.STATX_MNT_ID != 0, "fdrel %v: %s: no mount id", fdrel, r.Path)
+			if mnt == 0 {
+				mnt = sx.MntID
+			}
+			assert(sx.MntID == mnt, "fdrel %v: %s: mount id %d, exp %d", fdrel, r.Path, sx.MntID, mnt)
+
+			// not every file system knows when a file was born
+			if sx.Mask&unix.STATX_BTIME != 0 {
+				assert(sx.Btime.After(start), "fdrel %v: %s: wrong btime %s", fdrel, r.Path, sx.Btime)
+			}
+			n++
+		}
+		assert(n > 0, "fdrel %v: no results", fdrel)
+	}
+
+	// and nothing unless asked
+	for r, err := range All([]string{root}, &Options{Type: ALL}) {
+		assert(err == nil, "walk: %s", err)
+		assert(r.Statx == nil, "%s: unexpected statx", r.Path)
+	}
+}
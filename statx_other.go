@@ -0,0 +1,21 @@
+// statx_other.go - statx(2) stubs for non-linux platforms
+//
+// (c) 2022- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+//go:build !linux
+
+package walk
+
+// statx(2) is only supported on linux
+func (d *walkState) statx(e *entry) (*Statx, error) {
+	return nil, nil
+}
@@ -0,0 +1,198 @@
+// summary.go - post-order dir summaries for go-walk
+//
+// (c) 2022- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package walk
+
+import (
+	"os"
+	"sync"
+)
+
+// DirSummary describes a dir after all its descendants have been walked.
+// The counts include every entry walked - regardless of Options.Type and
+// Options.MinDepth; entries removed by Options.Excludes or Options.Filter
+// are not counted.
+type DirSummary struct {
+	// Root, RelPath and Depth are the same as that of the dir's Result
+	Root    string
+	RelPath string
+	Depth   int
+
+	// stat(2) info of the dir
+	Stat os.FileInfo
+
+	// Entries is the number of immediate entries of the dir
+	Entries int
+
+	// Files is the number of regular files in the subtree
+	Files int
+
+	// Dirs is the number of subdirs in the subtree
+	Dirs int
+
+	// Size is the total size of the regular files in the subtree;
+	// hardlinked files are counted once.
+	Size int64
+
+	// Blocks is the number of 512 byte blocks allocated to the dir and
+	// its subtree; hardlinked files are counted once.
+	Blocks int64
+
+	// Inodes is the number of distinct inodes in the dir and its subtree
+	Inodes int
+}
+
+// dirState tracks the progress of a dir's subtree
+type dirState struct {
+	sync.Mutex
+
+	nm     string
+	parent *dirState
+
+	// the dir itself and each of its subdirs that are yet to be done
+	pending int
+
+	// closed when the subtree is done
+	done chan struct{}
+
+	// set if the caller skipped this dir after we read it
+	skip bool
+
+	sum DirSummary
+}
+
+// make the state for the dir 'e'
+func newDirState(e *entry) *dirState {
+	ds := &dirState{
+		nm:      e.nm,
+		parent:  e.ds,
+		pending: 1,
+		done:    make(chan struct{}),
+		sum: DirSummary{
+			Root:    e.root,
+			RelPath: e.rel,
+			Depth:   e.depth,
+		},
+	}
+	return ds
+}
+
+// account for an entry 'fi' in the dir 'ds'; 'dup' is true if we've
+// seen this inode before (eg a hardlink).
+func (ds *dirState) account(fi os.FileInfo, dup bool) {
+	m := fi.Mode()
+
+	ds.Lock()
+	ds.sum.Entries++
+	if m.IsRegular() {
+		ds.sum.Files++
+	}
+
+	// subdirs account for themselves
+	if !dup && !m.IsDir() {
+		ds.sum.Inodes++
+		ds.sum.Blocks += statBlocks(fi)
+		if m.IsRegular() {
+			ds.sum.Size += fi.Size()
+		}
+	}
+	ds.Unlock()
+}
+
+// account for a subdir of 'ds' that we will walk; it is pending
+// until it is done
+func (ds *dirState) addDir() {
+	ds.Lock()
+	ds.sum.Dirs++
+	ds.pending++
+	ds.Unlock()
+}
+
+// keep the dir 'ds' pending till the sorted mode emitter is done with it
+func (ds *dirState) hold() {
+	ds.Lock()
+	ds.pending++
+	ds.Unlock()
+}
+
+// the caller skipped the dir 'ds' in the sorted mode after we read it;
+// like the unsorted mode, we only count the dir itself.
+func (ds *dirState) skipped() {
+	ds.Lock()
+	s := &ds.sum
+	*s = DirSummary{
+		Root:    s.Root,
+		RelPath: s.RelPath,
+		Depth:   s.Depth,
+		Stat:    s.Stat,
+		Inodes:  1,
+		Blocks:  statBlocks(s.Stat),
+	}
+	ds.skip = true
+	ds.Unlock()
+}
+
+// the dir 'ds' is done; when all of its subdirs are done, we
+// tell the caller and add its totals to its parent.
+func (d *walkState) dirDone(ds *dirState) {
+	for ds != nil {
+		ds.Lock()
+		ds.pending--
+		if ds.pending > 0 {
+			ds.Unlock()
+			return
+		}
+		sum := ds.sum
+		ds.Unlock()
+		close(ds.done)
+
+		// the emitter calls OnDirDone in the sorted mode; and we
+		// don't bother the caller about dirs we couldn't stat.
+		if d.srt == nil && sum.Stat != nil {
+			d.OnDirDone(ds.nm, sum)
+		}
+
+		p := ds.parent
+		if p != nil {
+			p.Lock()
+			if !p.skip {
+				p.sum.Files += sum.Files
+				p.sum.Dirs += sum.Dirs
+				p.sum.Size += sum.Size
+				p.sum.Blocks += sum.Blocks
+				p.sum.Inodes += sum.Inodes
+			}
+			p.Unlock()
+		}
+		ds = p
+	}
+}
+
+// the sorted mode emitter is done with the dir 'ds' and has let go of
+// it. The workers may still be busy with the subdirs the caller skipped;
+// so we wait for the subtree to be done.
+func (d *walkState) dirEmitted(ds *dirState) {
+	select {
+	case <-ds.done:
+	case <-d.ctx.Done():
+		return
+	}
+
+	ds.Lock()
+	sum := ds.sum
+	ds.Unlock()
+
+	if sum.Stat != nil {
+		d.OnDirDone(ds.nm, sum)
+	}
+}
@@ -0,0 +1,137 @@
+// summary_test.go -- tests for post-order dir callbacks
+
+package walk
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestOnDirDone(t *testing.T) {
+	assert := newAsserter(t)
+
+	root := t.TempDir()
+	mkTree(t, root, 3, 3)
+
+	// compute the expected totals
+	exp := make(map[string]*DirSummary)
+	err := filepath.WalkDir(root, func(p string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if de.IsDir() {
+			exp[p] = &DirSummary{}
+		}
+		if p == root {
+			return nil
+		}
+
+		fi, err := de.Info()
+		assert(err == nil, "info: %s", err)
+
+		exp[filepath.Dir(p)].Entries++
+		for dn := filepath.Dir(p); strings.HasPrefix(dn, root); dn = filepath.Dir(dn) {
+			s := exp[dn]
+			switch {
+			case de.IsDir():
+				s.Dirs++
+			case de.Type().IsRegular():
+				s.Files++
+				s.Size += fi.Size()
+			}
+		}
+		return nil
+	})
+	assert(err == nil, "walkdir: %s", err)
+
+	for _, sorted := range []bool{false, true} {
+		var mu sync.Mutex
+		var order []string
+		done := make(map[string]bool)
+
+		opt := &Options{
+			Type:   FILE,
+			Sorted: sorted,
+			OnDirDone: func(dir string, s DirSummary) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				assert(!done[dir], "%s: duplicate callback", dir)
+				done[dir] = true
+
+				x, ok := exp[dir]
+				assert(ok, "unexpected dir %s", dir)
+
+				// we must have seen every file and subdir under this dir
+				var n int
+				for _, p := range order {
+					if strings.HasPrefix(p, dir+"/") {
+						n++
+					}
+				}
+				assert(n == x.Files+x.Dirs, "%s: done before its descendants", dir)
+
+				assert(s.Stat.IsDir(), "%s: not a dir", dir)
+				assert(s.Entries == x.Entries && s.Files == x.Files && s.Dirs == x.Dirs && s.Size == x.Size,
+					"%s: exp %+v, saw %+v", dir, *x, s)
+				order = append(order, dir)
+			},
+		}
+
+		err := WalkFunc([]string{root}, opt, func(r Result) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			done[r.Path] = true
+			order = append(order, r.Path)
+			return nil
+		})
+		assert(err == nil, "walk: %s", err)
+
+		for k := range exp {
+			assert(done[k], "sorted %v: no callback for %s", sorted, k)
+		}
+		assert(order[len(order)-1] == root, "sorted %v: root is not the last", sorted)
+	}
+
+	// pruning a dir mustn't lose the rest of the tree
+	skip := filepath.Join(root, "dir-0", "dir-1")
+	for _, sorted := range []bool{false, true} {
+		var mu sync.Mutex
+		sums := make(map[string]DirSummary)
+
+		opt := &Options{
+			Type:   DIR,
+			Sorted: sorted,
+			OnDirDone: func(dir string, s DirSummary) {
+				mu.Lock()
+				sums[dir] = s
+				mu.Unlock()
+			},
+		}
+
+		err := WalkFunc([]string{root}, opt, func(r Result) error {
+			if r.Path == skip {
+				return SkipDir
+			}
+			return nil
+		})
+		assert(err == nil, "walk: %s", err)
+
+		s, ok := sums[root]
+		assert(ok, "sorted %v: no callback for root", sorted)
+		assert(sums[filepath.Join(root, "dir-0")].Stat != nil, "sorted %v: no callback for dir-0", sorted)
+
+		// the sorted mode reads the skipped dir before the caller
+		// sees it; but it mustn't count what it read.
+		assert(s.Files == 108 && s.Dirs == 36, "sorted %v: exp 108 files, 36 dirs; saw %d, %d", sorted, s.Files, s.Dirs)
+
+		x, ok := sums[skip]
+		assert(ok, "sorted %v: no callback for %s", sorted, skip)
+		assert(x.Entries == 0 && x.Files == 0 && x.Dirs == 0 && x.Inodes == 1,
+			"sorted %v: %s: exp an empty dir, saw %+v", sorted, skip, x)
+	}
+}
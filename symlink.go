@@ -0,0 +1,148 @@
+// symlink.go - symlink resolution for go-walk
+//
+// (c) 2022- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package walk
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// ErrDanglingLink is reported when a symlink being followed points to
+// a non-existent entry.
+var ErrDanglingLink = errors.New("dangling symlink")
+
+// SymlinkLoopError is reported when resolving a symlink leads to a loop,
+// takes more than Options.MaxSymlinks links or when a symlink points
+// to one of its parent dirs. It wraps syscall.ELOOP.
+type SymlinkLoopError struct {
+	// Path is the symlink being followed
+	Path string
+
+	// Chain is the sequence of paths we followed; the last element
+	// is where the loop closes.
+	Chain []string
+}
+
+func (e *SymlinkLoopError) Error() string {
+	return fmt.Sprintf("symlink %s: %s", e.Path, e.msg())
+}
+
+// the error without the path
+func (e *SymlinkLoopError) msg() string {
+	return "loop or too many links: " + strings.Join(e.Chain, " -> ")
+}
+
+func (e *SymlinkLoopError) Unwrap() error {
+	return syscall.ELOOP
+}
+
+// resolve all the symlinks in 'nm' by walking each component of the path
+// in turn; this is similar to filepath.EvalSymlinks() except it only uses
+// the walk's FileSystem and it tracks the links it follows. Each lstat
+// and readlink is charged to the walk.
+func (d *walkState) evalSymlinks(nm string) (string, error) {
+	max := d.MaxSymlinks
+	if max <= 0 {
+		max = _MaxSymlinks
+	}
+
+	// a valid path can go through the same link more than once; like
+	// the stdlib, we only give up after too many links.
+	var chain []string
+
+	// 'dest' is the fully resolved prefix and 'rest' is what remains
+	dest, rest := "", nm
+	if path.IsAbs(nm) {
+		dest, rest = "/", nm[1:]
+	}
+
+	for len(rest) > 0 {
+		var comp string
+
+		comp, rest, _ = strings.Cut(rest, "/")
+		switch comp {
+		case "", ".":
+			continue
+
+		case "..":
+			// 'dest' is free of symlinks; so we can lexically
+			// process '..'
+			switch {
+			case dest == "/":
+			case dest == "" || dest == ".." || strings.HasSuffix(dest, "/.."):
+				dest = joinPath(dest, comp)
+			default:
+				dest = path.Dir(dest)
+				if dest == "." {
+					dest = ""
+				}
+			}
+			continue
+		}
+
+		next := joinPath(dest, comp)
+		d.charge(1, 0)
+		fi, err := d.fsys.Lstat(next)
+		if err != nil {
+			return "", err
+		}
+
+		if (fi.Mode() & fs.ModeSymlink) == 0 {
+			dest = next
+			continue
+		}
+
+		chain = append(chain, next)
+		if len(chain) > max {
+			return "", &SymlinkLoopError{Path: nm, Chain: chain}
+		}
+
+		d.charge(1, 0)
+		targ, err := d.fsys.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		d.charge(0, len(targ))
+
+		// the link target is relative to the dir holding the link
+		if path.IsAbs(targ) {
+			dest, targ = "/", targ[1:]
+		}
+		if len(rest) > 0 {
+			rest = targ + "/" + rest
+		} else {
+			rest = targ
+		}
+	}
+
+	if len(dest) == 0 {
+		dest = "."
+	}
+	return dest, nil
+}
+
+// join a resolved prefix and a path component
+func joinPath(dir, nm string) string {
+	switch dir {
+	case "":
+		return nm
+	case "/":
+		return "/" + nm
+	}
+	return dir + "/" + nm
+}
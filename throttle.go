@@ -0,0 +1,149 @@
+// throttle.go - rate limits and politeness controls
+//
+// (c) 2022- Sudhi Herle <sudhi@herle.net>
+//
+// Licensing Terms: GPLv2
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package walk
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// how often we look at the system load
+	_LoadInterval = time.Second
+
+	// the rate limits allow bursts of this fraction of a second
+	_BurstFraction float64 = 0.1
+)
+
+// the load average of the system; tests can change it
+var loadavg = sysLoadavg
+
+// throttle enforces the rate limits and the load based pauses of a walk
+type throttle struct {
+	ops   *bucket
+	bytes *bucket
+
+	maxLoad float64
+
+	// the last time we looked at the load and what we saw
+	sync.Mutex
+	checked time.Time
+	high    bool
+}
+
+func newThrottle(opt *Options) *throttle {
+	if opt.MaxOpsPerSec <= 0 && opt.MaxBytesPerSec <= 0 && opt.MaxLoad <= 0 {
+		return nil
+	}
+
+	t := &throttle{
+		ops:     newBucket(opt.MaxOpsPerSec),
+		bytes:   newBucket(opt.MaxBytesPerSec),
+		maxLoad: opt.MaxLoad,
+	}
+	return t
+}
+
+// charge 'ops' file system operations and 'n' bytes read to the walk;
+// we wait as long as needed to stay within the limits.
+func (d *walkState) charge(ops, n int) {
+	if d.thr != nil {
+		d.thr.ops.take(d.ctx, ops)
+		d.thr.bytes.take(d.ctx, n)
+	}
+}
+
+// wait while the system is too busy
+func (t *throttle) pause(ctx context.Context) {
+	if t == nil || t.maxLoad <= 0 {
+		return
+	}
+
+	for t.busy() {
+		select {
+		case <-time.After(_LoadInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// return true if the system load is too high; we only look at the
+// load once in a while.
+func (t *throttle) busy() bool {
+	t.Lock()
+	defer t.Unlock()
+
+	if now := time.Now(); now.Sub(t.checked) >= _LoadInterval {
+		if load, ok := loadavg(); ok {
+			t.high = load > t.maxLoad
+		}
+		t.checked = now
+	}
+	return t.high
+}
+
+// bucket is a token bucket shared by all the workers of a walk. A taker
+// can go into debt; the ones that come after wait for it to be repaid.
+type bucket struct {
+	sync.Mutex
+
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate int) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	burst := max(float64(rate)*_BurstFraction, 1)
+	b := &bucket{
+		rate:   float64(rate),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+	return b
+}
+
+// take 'n' tokens from the bucket; wait till they're available or
+// the walk is cancelled. A nil bucket has infinite tokens.
+func (b *bucket) take(ctx context.Context, n int) {
+	if b == nil || n <= 0 {
+		return
+	}
+
+	b.Lock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.tokens -= float64(n)
+	b.last = now
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.Unlock()
+
+	if wait <= 0 {
+		return
+	}
+
+	tm := time.NewTimer(wait)
+	defer tm.Stop()
+	select {
+	case <-tm.C:
+	case <-ctx.Done():
+	}
+}
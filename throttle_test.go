@@ -0,0 +1,77 @@
+// throttle_test.go -- tests for rate limits and load based pauses
+
+package walk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	assert := newAsserter(t)
+
+	root := t.TempDir()
+	mkTree(t, root, 2, 3)
+
+	exp, err := oldWalk(&test{root, ALL})
+	assert(err == nil, "oldwalk: %s", err)
+
+	walk := func(opt *Options) time.Duration {
+		start := time.Now()
+		opt.Type = ALL
+		_, errs := allWalk(root, opt, exp)
+		assert(len(errs) == 0, "walk: %v", errs)
+		return time.Since(start)
+	}
+
+	// we do at least a readdir and an lstat for each of the 13 dirs;
+	// that is well over the burst we allow
+	d := walk(&Options{MaxOpsPerSec: 100})
+	assert(d >= 100*time.Millisecond, "ops: walk too fast: %s", d)
+
+	// and read at least the 52 names
+	d = walk(&Options{MaxBytesPerSec: 1000})
+	assert(d >= 100*time.Millisecond, "bytes: walk too fast: %s", d)
+
+	// a busy system pauses us till it isn't
+	var calls atomic.Int64
+	loadavg = func() (float64, bool) {
+		if calls.Add(1) == 1 {
+			return 10, true
+		}
+		return 0.5, true
+	}
+	defer func() {
+		loadavg = sysLoadavg
+	}()
+
+	d = walk(&Options{MaxLoad: 2})
+	assert(d >= _LoadInterval, "load: walk didn't pause: %s", d)
+	assert(calls.Load() >= 2, "load: exp at least 2 checks, saw %d", calls.Load())
+
+	// and a quiet one doesn't
+	calls.Store(1)
+	d = walk(&Options{MaxLoad: 2})
+	assert(d < _LoadInterval, "load: walk paused: %s", d)
+
+	// resolving a symlink costs an lstat per path component and a
+	// readlink per link
+	lnk := filepath.Join(root, "link")
+	err = os.Symlink("dir-0/file-0", lnk)
+	assert(err == nil, "symlink: %s", err)
+
+	ws := newWalkState(context.Background(), &Options{MaxOpsPerSec: 20})
+	defer ws.cancel()
+
+	ops := strings.Count(lnk, "/") + 3
+	start := time.Now()
+	_, err = ws.evalSymlinks(lnk)
+	d = time.Since(start)
+	assert(err == nil, "evalsymlinks: %s", err)
+	assert(d >= time.Duration(ops-2)*time.Second/20*9/10, "symlink: %d ops too fast: %s", ops, d)
+}
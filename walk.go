@@ -13,24 +13,27 @@
 
 // Package walk does a concurrent file system traversal and returns
 // each entry. Callers can filter the returned entries via `Options` or
-// a caller provided `Filter` function. This library uses all the available
-// CPUs (as returned by `runtime.NumCPU()`) to maximize concurrency of the
-// file tree traversal.
+// a caller provided `Filter` function. By default, this library uses all the
+// available CPUs (as returned by `runtime.GOMAXPROCS()`) to maximize
+// concurrency of the file tree traversal.
 //
 // This library can detect mount point crossings, follow symlinks and also
 // return extended attributes (xattr(7)).
 package walk
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path"
-	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
-	"syscall"
+	"time"
 )
 
 // High level design:
@@ -41,22 +44,38 @@ import (
 //
 // - each directory encountered bumps up a WaitGroup count (walkState::dirWg).
 //
+// - dirs are read in batches (unless the output is sorted); the subdirs
+//   in each batch are handed to the other workers before the next batch
+//   is read.
+//
+// - When the caller wants post-order callbacks, each dir being walked has
+//   a dirState that counts its pending subdirs. When a dir and all its
+//   subdirs are done, we call Options.OnDirDone and fold its totals into
+//   its parent.
+//
 // - Some filtering is done when we output via the `.output()` method and
 //   some filtering happens when we process entries from a directory.
+//
+// - the dirs waiting for a worker are in an unbounded queue
+//   (walkState::q); adding to it never blocks.
+//
+// - Cancellation is driven by walkState::ctx. Once it is done, every
+//   blocking send selects on ctx.Done() and the workers drain the queue
+//   without processing it. This lets dirWg go to zero and the channels
+//   are closed as usual.
 
 const (
 
-	// we use one worker per CPU core for the concurrent walker.
+	// by default, we use one worker per CPU core for the concurrent walker.
 	// ParallelismFactor multiples the number of go-routines.
 	_ParallelismFactor int = 2
 
-	// Max number of consecutive symlinks we will follow
+	// Default max number of consecutive symlinks we will follow
 	_MaxSymlinks int = 100
-)
 
-// the channels used for internal use and callers are all buffered.
-// We don't want the producers to be blocked.
-var _Chansize = _ParallelismFactor * runtime.NumCPU()
+	// max number of dir entries we read at a time
+	_ReadDirBatch int = 1024
+)
 
 // Type describes the type of a given file system entry.
 type Type uint
@@ -86,12 +105,132 @@ type Options struct {
 	// Types of entries to return
 	Type Type
 
+	// MaxDepth limits the descent to this many levels below each
+	// entry passed to Walk(); the entries themselves are at depth 0.
+	// Directories at MaxDepth are returned but not read. A value
+	// of 0 means no limit.
+	MaxDepth int
+
+	// MinDepth suppresses the output of entries that are less than
+	// this many levels below each entry passed to Walk(). The walk
+	// still descends into such directories.
+	MinDepth int
+
+	// MaxSymlinks is the max number of symlinks we will follow while
+	// resolving a single path. If zero, a default of 100 is used.
+	MaxSymlinks int
+
+	// LogicalPaths, when set along with FollowSymlinks, reports entries
+	// under the path they were found at (eg root/link/child) instead of
+	// the path with symlinks resolved. The resolved path is available
+	// in Result.Resolved.
+	LogicalPaths bool
+
+	// ReadLinks, when set and FollowSymlinks is not, reads the target of
+	// every returned symlink into Result.LinkTarget and flags dangling
+	// symlinks in Result.Dangling.
+	ReadLinks bool
+
+	// Sorted, when set, returns the results in lexical order of a depth
+	// first walk - like filepath.WalkDir(); the entries passed to Walk()
+	// are walked in the order given. The traversal is still concurrent,
+	// but the results are delivered (and the WalkFunc callback is called)
+	// from a single go-routine. Errors are not ordered.
+	Sorted bool
+
+	// StatxMask, when non-zero, fetches the unix.STATX_* fields named in
+	// it (eg STATX_BTIME, STATX_MNT_ID, STATX_DIOALIGN) into Result.Statx
+	// for every returned result. It is only supported on linux with the
+	// host file system and ignored otherwise.
+	StatxMask uint32
+
+	// LazyStat, when set, leaves Result.Stat unset for entries the walk
+	// didn't have to stat itself; Result.Info() fetches it on demand and
+	// Result.Type() returns the type bits without a stat. This saves an
+	// lstat(2) per entry for callers that only need the paths.
+	LazyStat bool
+
+	// FdRelative, when set, walks each dir relative to an open fd of its
+	// parent (openat(2) and fstatat(2) with O_NOFOLLOW) instead of its
+	// full path. A dir that is renamed or replaced by a symlink during
+	// the walk can't lead us astray. The symlinks read in the ReadLinks
+	// mode are read relative to their dir too; but xattrs and symlinks
+	// that are followed are still resolved by their full path. It is
+	// only supported on linux with the host file system and ignored
+	// otherwise.
+	FdRelative bool
+
+	// MaxFds is the max number of dir fds kept open in the FdRelative
+	// mode for dirs whose subdirs are yet to be walked; beyond this, the
+	// subdirs are opened by their path and checked against what we saw.
+	// If zero, a default of 256 is used.
+	MaxFds int
+
+	// Workers is the number of dirs a walk reads concurrently. Slow
+	// file systems (eg NFS) benefit from more I/O in flight than there
+	// are CPUs. If zero, a default of twice runtime.GOMAXPROCS() is used.
+	Workers int
+
+	// QueueSize is the number of results buffered in the chan returned
+	// by Walk(); in the Sorted mode, it also bounds the number of dirs
+	// read ahead of the output. If zero, it is twice the number of
+	// workers.
+	QueueSize int
+
+	// Adaptive, when set, varies the number of active workers between
+	// 1 and Workers based on the observed readdir(2) and lstat(2)
+	// latency; like TCP congestion control. If Workers is zero, a walk
+	// in the Adaptive mode can grow to 4 times the default.
+	Adaptive bool
+
+	// MaxOpsPerSec, when non-zero, limits the rate of file system
+	// operations (readdir(2), lstat(2), readlink(2), getxattr(2) etc.)
+	// done by all the workers of a walk.
+	MaxOpsPerSec int
+
+	// MaxBytesPerSec, when non-zero, limits the rate at which all the
+	// workers of a walk read dir entries, symlink targets and xattrs.
+	MaxBytesPerSec int
+
+	// MaxLoad, when non-zero, pauses the walk while the 1 minute load
+	// average of the system is above it. It is only supported on linux.
+	MaxLoad float64
+
+	// Pool is an optional pool of workers shared by several concurrent
+	// walks; it bounds the total number of dirs read at a time by all of
+	// them. A walk whose results aren't consumed holds on to its share
+	// of the pool.
+	Pool *Pool
+
 	// Excludes is a list of shell-glob patterns to exclude from
 	// the walk. If a dir matches the prefix, go-walk does
 	// not descend that subdirectory. The matching is done on the basename
 	// component of the relative pathname.
 	Excludes []string
 
+	// FileSystem is the backend used for all file system operations.
+	// If nil, the walk uses the host file system.
+	FileSystem FileSystem
+
+	// ErrorsInResult, when set, delivers the errors encountered by Walk()
+	// in Result.Err on the result channel; nothing is sent on the error
+	// channel. This lets a caller safely service just the result channel.
+	// It has no effect on WalkFunc().
+	ErrorsInResult bool
+
+	// OnError is an optional caller provided callback that is
+	// consulted for every file system error encountered during the
+	// walk; its return value decides what happens next. It must be
+	// concurrency-safe. If nil, all errors are reported and the walk
+	// continues.
+	OnError func(err *Error) Action
+
+	// OnDirDone is an optional caller provided callback that is called
+	// for every dir walked - after all its descendants have been delivered
+	// to the caller. It must be concurrency-safe; in the Sorted mode, it is
+	// called in the same go-routine that delivers the results.
+	OnDirDone func(dir string, summary DirSummary)
+
 	// Filter is an optional caller provided callback
 	// This function must return True if this entry should
 	// no longer be processed. ie filtered out. 'nm' is the full
@@ -99,25 +238,111 @@ type Options struct {
 	Filter func(nm string, fi os.FileInfo) bool
 }
 
+// SkipDir is used as a return value from the WalkFunc callback to indicate
+// that the directory named in the call is to be skipped. It is ignored when
+// returned for any other entry.
+var SkipDir = fs.SkipDir
+
+// SkipAll is used as a return value from the WalkFunc callback to indicate
+// that all remaining entries are to be skipped. The concurrent walk is
+// stopped and WalkFunc returns without an error.
+var SkipAll = fs.SkipAll
+
 // Result is the data returned as part of the directory walk
 type Result struct {
 	// path relative to the supplied argument
 	Path string
 
-	// stat(2) info
+	// Root is the entry passed to Walk() that led to this result
+	Root string
+
+	// RelPath is the path of this result relative to Root; it
+	// reflects the path taken from Root even when symlinks are
+	// followed. The RelPath of Root itself is ".".
+	RelPath string
+
+	// Depth is the number of levels below Root; Root is at depth 0.
+	Depth int
+
+	// LinkTarget is the target of a symlink as returned by readlink(2).
+	// It is only set for followed symlinks in the LogicalPaths mode and
+	// for symlinks that aren't followed in the ReadLinks mode.
+	LinkTarget string
+
+	// Dangling is set in the ReadLinks mode for symlinks whose target
+	// doesn't exist.
+	Dangling bool
+
+	// Resolved is the path of this entry with all symlinks resolved.
+	// It is only set in the LogicalPaths mode for entries that were
+	// reached via a symlink.
+	Resolved string
+
+	// stat(2) info; in the LazyStat mode, this may be nil - use
+	// Info() instead.
 	Stat os.FileInfo
 
 	// extended attributes for this file
 	// set only if user requests it
 	Xattr Xattr
+
+	// statx(2) info for this file; set only if the user requests it
+	// via Options.StatxMask
+	Statx *Statx
+
+	// Err is set for errors reported in the ErrorsInResult mode;
+	// only Path and Root are valid in such a result.
+	Err error
+
+	// the dir entry to stat lazily
+	de fs.DirEntry
+}
+
+// Info returns the lstat(2) info of this result; in the LazyStat mode it
+// stats the entry on first use and caches the info in r.Stat.
+func (r *Result) Info() (os.FileInfo, error) {
+	if r.Stat == nil && r.de != nil {
+		fi, err := r.de.Info()
+		if err != nil {
+			return nil, &Error{Op: "lstat", Path: r.Path, Root: r.Root, Err: err}
+		}
+		r.Stat = fi
+	}
+	if r.Stat == nil {
+		return nil, r.Err
+	}
+	return r.Stat, nil
+}
+
+// Type returns the type bits of this result without a stat(2)
+func (r *Result) Type() fs.FileMode {
+	switch {
+	case r.Stat != nil:
+		return r.Stat.Mode().Type()
+	case r.de != nil:
+		return r.de.Type()
+	}
+	return 0
 }
 
 // internal state
 type walkState struct {
 	Options
-	ch    chan string
-	out   chan Result
-	errch chan error
+	fsys   FileSystem
+	ctx    context.Context
+	cancel context.CancelFunc
+	q      *workQueue
+	out    chan Result
+	errch  chan error
+
+	// if set, errors are sent as results on this chan
+	resch chan Result
+
+	// orders the output in the sorted mode
+	srt *sorter
+
+	// walks dirs relative to their parent in the FdRelative mode
+	fdw *fdWalker
 
 	// type mask for output filtering
 	typ os.FileMode
@@ -130,16 +355,103 @@ type walkState struct {
 	// Tracks worker goroutines
 	wg sync.WaitGroup
 
+	// the number of workers and the number of results we buffer; the
+	// latter also bounds the dirs read ahead in the sorted mode.
+	workers int
+	qsize   int
+
+	// bounds the number of active workers in the Adaptive mode
+	lim *limiter
+
+	// the rate limits and load based pauses
+	thr *throttle
+
 	singlefs func(nm string, fi os.FileInfo) bool
 
-	// the output action - either send info via chan or call user supplied func
-	apply func(nm string, fi os.FileInfo)
+	// set if we need the full info of every dir entry; otherwise we
+	// make do with the type bits from readdir and stat lazily
+	statAll bool
+
+	// the output action - either send info via chan or call user supplied func.
+	// A return value of SkipDir for a directory prevents us from descending it.
+	apply func(r Result) error
 
-	// Tracks device major:minor to detect mount-point crossings
+	// Tracks devices to detect mount-point crossings and
+	// inodes to detect loops
 	fs  sync.Map
 	ino sync.Map
 }
 
+// a path in the walk and its position relative to its root.
+// When we follow symlinks, 'nm' is the resolved path while 'rel'
+// continues to track the path we took from the root. In the
+// LogicalPaths mode, 'nm' is the path we took and 'real' is the
+// resolved path.
+type entry struct {
+	nm    string
+	real  string
+	link  string
+	root  string
+	rel   string
+	depth int
+
+	// set if this is a symlink whose target doesn't exist
+	dangling bool
+
+	// the dirs leading to this entry; only tracked when we
+	// follow symlinks
+	up *dirID
+
+	// the node collecting results in the sorted mode
+	n *node
+
+	// the state of the dir holding this entry; once a worker picks
+	// up a dir, this is the state of the dir itself. Only tracked when
+	// the caller wants post-order callbacks.
+	ds *dirState
+
+	// the dir entry we came from; lets us stat lazily when the
+	// caller doesn't need the full info of every entry
+	de fs.DirEntry
+
+	// the open parent dir of this dir in the FdRelative mode; if we
+	// have to open this dir by its path instead, 'want' is what we
+	// saw in its parent.
+	dh   *dirHandle
+	want *FileID
+}
+
+// a dir in the chain of dirs leading to an entry
+type dirID struct {
+	id FileID
+	up *dirID
+}
+
+// return the size of the names in 'dev'
+func direntSize(dev []fs.DirEntry) int {
+	n := 0
+	for _, de := range dev {
+		n += len(de.Name())
+	}
+	return n
+}
+
+// return the path to use for file system operations
+func (e *entry) path() string {
+	if len(e.real) > 0 {
+		return e.real
+	}
+	return e.nm
+}
+
+// drop the ref on the open parent of a dir we're done with
+func (e *entry) drop() {
+	if e.dh != nil {
+		e.dh.put()
+		e.dh = nil
+	}
+}
+
 // mapping our types to the stdlib types
 var typMap = map[Type]os.FileMode{
 	FILE:    0,
@@ -172,71 +484,68 @@ func (t Type) String() string {
 // results in a channel of Result. The caller must service the channel. Any errors
 // encountered during the walk are returned in the error channel.
 func Walk(names []string, opt *Options) (chan Result, chan error) {
-	out := make(chan Result, _Chansize*2)
-	d := newWalkState(opt)
-
-	// This function sends output to a chan
-	d.apply = func(nm string, fi os.FileInfo) {
-		r := Result{
-			Path: nm,
-			Stat: fi,
-		}
-		if d.Xattr {
-			x, err := getxattr(nm)
-			if err != nil {
-				d.errch <- err
-				return
-			}
-			r.Xattr = x
-		}
-		out <- r
-	}
-
-	d.doWalk(names)
-
-	// close the channels when we're all done
-	go func() {
-		d.dirWg.Wait()
-		close(d.ch)
-		close(out)
-		close(d.errch)
-		d.wg.Wait()
-	}()
+	return WalkContext(context.Background(), names, opt)
+}
 
+// WalkContext is like Walk except the traversal is aborted when 'ctx' is
+// cancelled. Upon cancellation, the workers stop processing entries, both
+// channels are closed and ctx.Err() is queued on the error channel (if the
+// caller has left room in the error channel). A caller may stop servicing
+// the channels once it has cancelled 'ctx'; no go-routines are leaked.
+func WalkContext(ctx context.Context, names []string, opt *Options) (chan Result, chan error) {
+	d := newWalkState(ctx, opt)
+	out := d.walkChan(ctx, names)
 	return out, d.errch
 }
 
+// WalkFS is like Walk except it traverses the entries in 'roots' within the
+// file system 'fsys'. The roots and the returned paths are slash separated
+// paths as defined by io/fs. Symlinks are only recognized if 'fsys'
+// implements ReadLink() and Lstat() like os.DirFS. If 'fsys' doesn't expose
+// device info, Options.OneFS is a no-op; Options.Xattr is always a no-op.
+func WalkFS(fsys fs.FS, roots []string, opt *Options) (chan Result, chan error) {
+	var o Options
+	if opt != nil {
+		o = *opt
+	}
+	o.FileSystem = FromFS(fsys)
+	return Walk(roots, &o)
+}
+
 // WalkFunc traverses the entries in 'names' in a concurrent fashion and calls 'apply'
 // for entries that match criteria in 'opt'. The apply function must be concurrency-safe
 // ie it will be called concurrently from multiple go-routines. Any errors reported by
-// 'apply' will be returned from WalkFunc().
+// 'apply' will be returned from WalkFunc(). The apply function can return SkipDir
+// to prune a directory or SkipAll to stop the walk altogether.
 func WalkFunc(names []string, opt *Options, apply func(r Result) error) error {
-	d := newWalkState(opt)
+	return WalkFuncContext(context.Background(), names, opt, apply)
+}
 
-	// This calls the caller supplied 'apply' func
-	d.apply = func(nm string, fi os.FileInfo) {
-		r := Result{
-			Path: nm,
-			Stat: fi,
-		}
+// WalkFuncContext is like WalkFunc except the traversal is aborted when 'ctx'
+// is cancelled. In that case, the returned error includes ctx.Err().
+func WalkFuncContext(ctx context.Context, names []string, opt *Options, apply func(r Result) error) error {
+	d := newWalkState(ctx, opt)
 
-		if d.Xattr {
-			x, err := getxattr(nm)
-			if err != nil {
-				d.errch <- err
-				return
-			}
-			r.Xattr = x
+	// This calls the caller supplied 'apply' func
+	d.apply = func(r Result) error {
+		// don't bother the caller once the walk is stopped
+		if d.ctx.Err() != nil {
+			return nil
 		}
 
-		if err := apply(r); err != nil {
-			d.errch <- err
-			return
+		err := apply(r)
+		switch {
+		case err == nil:
+		case err == SkipDir:
+			return err
+		case err == SkipAll:
+			d.cancel()
+		default:
+			d.sendErr(err)
 		}
+		return nil
 	}
 
-	d.doWalk(names)
-
 	// harvest errors and prepare to return
 	var errWg sync.WaitGroup
 	var errs []error
@@ -249,12 +558,16 @@ func WalkFunc(names []string, opt *Options, apply func(r Result) error) error {
 		errWg.Done()
 	}(d.errch)
 
+	d.doWalk(names)
+
 	// close the channels when we're all done
-	d.dirWg.Wait()
-	close(d.ch)
+	d.wait()
 	close(d.errch)
 	errWg.Wait()
-	d.wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
+	}
 
 	if len(errs) > 0 {
 		return errors.Join(errs...)
@@ -262,22 +575,94 @@ func WalkFunc(names []string, opt *Options, apply func(r Result) error) error {
 	return nil
 }
 
-func newWalkState(opt *Options) *walkState {
+func newWalkState(ctx context.Context, opt *Options) *walkState {
 	if opt == nil {
 		opt = &Options{}
 	}
 
 	d := &walkState{
 		Options: *opt,
-		ch:      make(chan string, _Chansize),
 		errch:   make(chan error, 8),
 		singlefs: func(string, os.FileInfo) bool {
 			return true
 		},
 	}
+
+	// the channels used for internal use and callers are all buffered.
+	// We don't want the producers to be blocked.
+	nworkers := runtime.GOMAXPROCS(0) * _ParallelismFactor
+	d.workers = d.Workers
+	if d.workers <= 0 {
+		d.workers = nworkers
+		if d.Adaptive {
+			d.workers *= _AdaptiveFactor
+		}
+	}
+	d.qsize = d.QueueSize
+	if d.qsize <= 0 {
+		d.qsize = d.workers * 2
+	}
+	d.q = newWorkQueue()
+
+	d.fsys = d.FileSystem
+	if d.fsys == nil {
+		d.fsys = osFS{}
+	}
+	if _, ok := d.fsys.(osFS); ok && d.FdRelative {
+		d.fdw = newFdWalker(d.MaxFds)
+	}
+
+	d.ctx, d.cancel = context.WithCancel(ctx)
+	if d.Adaptive {
+		d.lim = newLimiter(d.ctx, nworkers, d.workers)
+	}
+	d.thr = newThrottle(opt)
 	return d
 }
 
+// start a walk of 'names' that sends its results to a chan. Both the
+// returned chan and the error chan are closed when the walk completes.
+func (d *walkState) walkChan(ctx context.Context, names []string) chan Result {
+	out := make(chan Result, d.qsize)
+
+	// This function sends output to a chan
+	d.apply = func(r Result) error {
+		select {
+		case out <- r:
+		case <-d.ctx.Done():
+		}
+		return nil
+	}
+
+	if d.ErrorsInResult {
+		d.resch = out
+	}
+
+	// start the walk and close the channels when we're all done
+	go func() {
+		d.doWalk(names)
+		d.wait()
+
+		if err := ctx.Err(); err != nil {
+			if d.resch != nil {
+				select {
+				case out <- Result{Err: err}:
+				default:
+				}
+			} else {
+				select {
+				case d.errch <- err:
+				default:
+				}
+			}
+		}
+		close(out)
+		close(d.errch)
+	}()
+
+	return out
+}
+
 // walk the entries in 'names'; this creates workers to
 // traverse the FS in a concurrent fashion.
 func (d *walkState) doWalk(names []string) {
@@ -285,6 +670,10 @@ func (d *walkState) doWalk(names []string) {
 		d.singlefs = d.isSingleFS
 	}
 
+	// the caller's filter, dedup across a single fs and the per-dir
+	// summaries all need the full info of every entry
+	d.statAll = d.Filter != nil || d.OneFS || d.OnDirDone != nil
+
 	// default accept filter
 	if d.Filter == nil {
 		// by default - "don't filter anything"
@@ -301,15 +690,24 @@ func (d *walkState) doWalk(names []string) {
 		}
 	}
 
-	nworkers := runtime.NumCPU() * _ParallelismFactor
-	d.wg.Add(nworkers)
-	for i := 0; i < nworkers; i++ {
+	d.wg.Add(d.workers)
+	for i := 0; i < d.workers; i++ {
 		go d.worker()
 	}
 
+	var root *node
+	if d.Sorted {
+		d.srt = newSorter(d)
+		root = d.srt.root()
+	}
+
 	// send work to workers
-	dirs := make([]string, 0, len(names))
+	dirs := make([]entry, 0, len(names))
 	for i := range names {
+		if d.ctx.Err() != nil {
+			break
+		}
+
 		var fi os.FileInfo
 		var err error
 
@@ -318,13 +716,14 @@ func (d *walkState) doWalk(names []string) {
 			nm = "/"
 		}
 
-		if d.exclude(nm) {
+		if d.exclude(nm, nm) {
 			continue
 		}
 
-		fi, err = os.Lstat(nm)
+		d.charge(1, 0)
+		fi, err = d.fsys.Lstat(nm)
 		if err != nil {
-			d.error("lstat %s: %w", nm, err)
+			d.error("lstat", nm, nm, err)
 			continue
 		}
 
@@ -337,44 +736,73 @@ func (d *walkState) doWalk(names []string) {
 			continue
 		}
 
+		e := entry{
+			nm:   nm,
+			root: nm,
+			rel:  ".",
+			n:    root,
+		}
 		m := fi.Mode()
 		switch {
 		case m.IsDir():
 			if d.OneFS {
 				d.trackFS(fi, nm)
 			}
-			dirs = append(dirs, nm)
+			dirs = d.addDir(dirs, e)
 
 		case (m & os.ModeSymlink) > 0:
 			// we may have new info now. The symlink may point to file, dir or
 			// special.
-			dirs = d.doSymlink(nm, fi, dirs)
+			dirs = d.doSymlink(e, fi, dirs)
 
 		default:
-			d.output(nm, fi)
+			d.output(e, fi)
 		}
 	}
 
 	// queue the dirs
 	d.enq(dirs)
 
+	if d.srt != nil {
+		d.srt.finish(root)
+		go d.srt.run(root)
+	}
+}
+
+// wait for the walk to complete and the workers to exit
+func (d *walkState) wait() {
+	if d.srt != nil {
+		<-d.srt.fin
+	}
+	d.dirWg.Wait()
+	d.q.close()
+	d.wg.Wait()
+	if d.srt != nil {
+		d.srt.drop()
+	}
+	d.cancel()
 }
 
 // worker thread to walk directories
 func (d *walkState) worker() {
-	for nm := range d.ch {
-		fi, err := os.Lstat(nm)
-		if err != nil {
-			d.error("lstat %s: %w", nm, err)
-			d.dirWg.Done()
-			continue
+	for {
+		e, ok := d.q.pop()
+		if !ok {
+			break
 		}
 
-		// we are _sure_ this is a dir.
-		d.output(nm, fi)
+		// drain the queue if we've been cancelled
+		if d.acquire() {
+			d.doDir(e)
+			d.release()
+		}
+
+		if d.srt != nil {
+			d.srt.finish(e.n)
+		}
 
-		// Now process the contents of this dir
-		d.walkPath(nm)
+		// we're done with the parent dir
+		e.drop()
 
 		// It is crucial that we do this as the last thing in the processing loop.
 		// Otherwise, we have a race condition where the workers will prematurely quit.
@@ -385,21 +813,162 @@ func (d *walkState) worker() {
 	d.wg.Done()
 }
 
-// output action for entries we encounter
-func (d *walkState) output(nm string, fi os.FileInfo) {
-	m := fi.Mode()
+// wait for our turn to process a dir; return false if we're cancelled
+func (d *walkState) acquire() bool {
+	d.thr.pause(d.ctx)
+	if !d.lim.get(d.ctx) {
+		return false
+	}
+	if !d.Pool.get(d.ctx) {
+		d.lim.put()
+		return false
+	}
+	return true
+}
+
+// give up our turn once we're done with a dir
+func (d *walkState) release() {
+	d.Pool.put()
+	d.lim.put()
+}
+
+// process a dir we pulled off the queue
+func (d *walkState) doDir(e entry) {
+	if d.OnDirDone != nil {
+		ds := newDirState(&e)
+		e.ds = ds
+		defer d.dirDone(ds)
+	}
+
+	// the emitter doesn't want this dir anymore
+	if d.srt != nil && !d.srt.start(e.n, e.ds) {
+		return
+	}
+
+	var fi os.FileInfo
+	var err error
+	d.charge(1, 0)
+	t0 := time.Now()
+	if d.fdw != nil {
+		fi, err = d.fdw.lstat(&e)
+	} else {
+		fi, err = d.fsys.Lstat(e.path())
+	}
+	d.lim.sample(time.Since(t0), 1)
+	if err != nil {
+		d.error("lstat", e.nm, e.root, err)
+		return
+	}
+
+	if e.ds != nil {
+		e.ds.sum.Stat = fi
+		e.ds.sum.Inodes = 1
+		e.ds.sum.Blocks = statBlocks(fi)
+	}
+
+	// track the ancestors of our children to detect symlink loops
+	if d.FollowSymlinks {
+		if id, ok := d.fsys.FileID(fi); ok {
+			e.up = &dirID{id, e.up}
+		}
+	}
+
+	// we are _sure_ this is a dir. Process its contents
+	// unless the caller wants us to skip it or we're too deep.
+	err = d.output(e, fi)
+	if err != SkipDir && (d.MaxDepth <= 0 || e.depth < d.MaxDepth) {
+		d.walkPath(e)
+	}
+}
+
+// output action for entries we encounter. Return SkipDir if the caller
+// doesn't want us to descend this entry.
+func (d *walkState) output(e entry, fi os.FileInfo) error {
+	if e.depth < d.MinDepth {
+		return nil
+	}
+
+	var m os.FileMode
+	if fi != nil {
+		m = fi.Mode()
+	} else {
+		m = e.de.Type()
+	}
 
 	// we have to special case regular files because there is
 	// no mask for Regular Files!
 	//
 	// For everyone else, we can consult the typ map
 	if (d.typ&m) > 0 || ((d.Type&FILE) > 0 && m.IsRegular()) {
-		d.apply(nm, fi)
+		// we only stat the entries we actually output; and if the
+		// caller wants, not even those.
+		if fi == nil && !d.LazyStat {
+			var err error
+			d.charge(1, 0)
+			if fi, err = e.de.Info(); err != nil {
+				if d.error("lstat", e.nm, e.root, err) != ActionContinue {
+					return SkipDir
+				}
+				return nil
+			}
+		}
+
+		r, ok, act := d.result(e, fi)
+		if act != ActionContinue {
+			return SkipDir
+		}
+		if ok {
+			// the emitter calls apply in the sorted mode
+			if d.srt != nil {
+				e.n.items = append(e.n.items, item{r: r})
+				return nil
+			}
+			return d.apply(r)
+		}
 	}
+	return nil
+}
+
+// make a result for an entry we're about to output; if we can't, return
+// false and the caller's choice of what to do next.
+func (d *walkState) result(e entry, fi os.FileInfo) (Result, bool, Action) {
+	r := Result{
+		Path:       e.nm,
+		Root:       e.root,
+		RelPath:    e.rel,
+		Depth:      e.depth,
+		Stat:       fi,
+		LinkTarget: e.link,
+		Dangling:   e.dangling,
+		Resolved:   e.real,
+	}
+	if fi == nil {
+		r.de = e.de
+	}
+
+	if d.Xattr {
+		d.charge(1, 0)
+		x, err := d.fsys.Getxattr(e.path())
+		if err != nil {
+			return r, false, d.error("getxattr", e.nm, e.root, err)
+		}
+		d.charge(0, x.size())
+		r.Xattr = x
+	}
+
+	if d.StatxMask != 0 {
+		d.charge(1, 0)
+		sx, err := d.statx(&e)
+		if err != nil {
+			return r, false, d.error("statx", e.nm, e.root, err)
+		}
+		r.Statx = sx
+	}
+	return r, true, ActionContinue
 }
 
 // return true iff basename(nm) matches one of the patterns
-func (d *walkState) exclude(nm string) bool {
+func (d *walkState) exclude(nm, root string) bool {
 	if len(d.Excludes) == 0 {
 		return false
 	}
@@ -408,7 +977,7 @@ func (d *walkState) exclude(nm string) bool {
 	for _, pat := range d.Excludes {
 		ok, err := path.Match(pat, bn)
 		if err != nil {
-			d.errch <- fmt.Errorf("glob '%s': %s", pat, err)
+			d.error("glob", nm, root, fmt.Errorf("'%s': %w", pat, err))
 		} else if ok {
 			return true
 		}
@@ -417,108 +986,275 @@ func (d *walkState) exclude(nm string) bool {
 	return false
 }
 
-// enqueue a list of dirs in a separate go-routine so the caller is
-// not blocked (deadlocked)
-func (d *walkState) enq(dirs []string) {
+// add a dir to the list of dirs to be walked; in the sorted mode, this
+// also reserves its place among the results of its parent.
+func (d *walkState) addDir(dirs []entry, e entry) []entry {
+	if d.srt != nil {
+		e.n = d.srt.newNode(e)
+	}
+	if e.ds != nil {
+		e.ds.addDir()
+	}
+	return append(dirs, e)
+}
+
+// queue a list of dirs for the workers. In the sorted mode, the sorter
+// decides when they are dispatched.
+func (d *walkState) enq(dirs []entry) {
+	if d.srt != nil {
+		dirs = d.srt.add(dirs)
+	}
+	d.dispatch(dirs)
+}
+
+// hand a list of dirs to the workers; this never blocks the caller
+func (d *walkState) dispatch(dirs []entry) {
 	if len(dirs) > 0 {
 		d.dirWg.Add(len(dirs))
-		go func(dirs []string) {
-			for _, nm := range dirs {
-				d.ch <- nm
-			}
-		}(dirs)
+		d.q.push(dirs)
 	}
 }
 
 // Process a directory and return the list of subdirs
 //
-// There is *no* race condition between the workers reading d.ch and the
+// There is *no* race condition between the workers reading d.q and the
 // wait-group going to zero: there is at least 1 count outstanding: of the
 // current entry being processed. So, this function can take as long as it wants
 // the caller (d.worker()) won't decrement that wait-count until this function
 // returns. And by then the wait-count would've been bumped up by the number of
 // dirs we've seen here.
-func (d *walkState) walkPath(nm string) {
-	fd, err := os.Open(nm)
+func (d *walkState) walkPath(dir entry) {
+	fd, err := d.openDir(&dir)
 	if err != nil {
-		d.error("%s: %s", nm, err)
+		d.error("readdir", dir.nm, dir.root, err)
 		return
 	}
-	defer fd.Close()
 
-	fiv, err := fd.Readdir(-1)
-	if err != nil {
-		d.error("%s: %s", nm, err)
+	// the subdirs are opened relative to this dir in the FdRelative mode
+	h, _ := fd.(*dirHandle)
+
+	// in the sorted mode, we need all the entries up front
+	if fd == nil || d.srt != nil {
+		var dev []fs.DirEntry
+
+		// we may have a partial list of entries in case of errors
+		d.charge(1, 0)
+		t0 := time.Now()
+		if fd == nil {
+			dev, err = d.fsys.ReadDir(dir.path())
+		} else {
+			defer fd.Close()
+			dev, err = fd.ReadDir(-1)
+		}
+		d.lim.sample(time.Since(t0), len(dev)/_DirentsPerCall)
+		d.charge(len(dev)/_DirentsPerCall, direntSize(dev))
+		if err != nil {
+			if d.error("readdir", dir.nm, dir.root, err) != ActionContinue {
+				return
+			}
+		}
+
+		if d.srt != nil {
+			slices.SortFunc(dev, func(a, b fs.DirEntry) int {
+				return strings.Compare(a.Name(), b.Name())
+			})
+		}
+
+		d.enq(d.walkEntries(dir, dev, h))
 		return
 	}
 
-	// hack to make joined paths not look like '//file'
-	if nm == "/" {
-		nm = ""
+	// read the entries in batches and hand out the subdirs of each
+	// batch to the workers before reading the next. This bounds the
+	// memory used by huge dirs and keeps the other workers busy in
+	// the meantime.
+	defer fd.Close()
+	for d.ctx.Err() == nil {
+		// we may have a partial list of entries in case of errors;
+		// but we can't read past the error.
+		d.charge(1, 0)
+		t0 := time.Now()
+		dev, err := fd.ReadDir(_ReadDirBatch)
+		d.lim.sample(time.Since(t0), len(dev)/_DirentsPerCall)
+		d.charge(len(dev)/_DirentsPerCall, direntSize(dev))
+		if err != nil && err != io.EOF {
+			if d.error("readdir", dir.nm, dir.root, err) != ActionContinue {
+				return
+			}
+		}
+
+		d.enq(d.walkEntries(dir, dev, h))
+		if err != nil {
+			return
+		}
 	}
+}
 
-	dirs := make([]string, 0, len(fiv)/2)
-	for i := range fiv {
-		fi := fiv[i]
-		m := fi.Mode()
+// open 'dir' to read its entries in batches; return nil if the
+// file system can't do that.
+func (d *walkState) openDir(dir *entry) (dirFile, error) {
+	if d.fdw != nil {
+		d.charge(1, 0)
+		h, err := d.fdw.openDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		return h, nil
+	}
 
-		// we don't want to use filepath.Join() because it "cleans"
-		// the path (removes the leading .)
-		fp := fmt.Sprintf("%s/%s", nm, fi.Name())
+	if od, ok := d.fsys.(dirOpener); ok {
+		d.charge(1, 0)
+		return od.OpenDir(dir.path())
+	}
+	return nil, nil
+}
 
-		if d.exclude(fp) {
-			continue
+// process the entries of 'dir' and return the subdirs to be walked
+func (d *walkState) walkEntries(dir entry, dev []fs.DirEntry, h *dirHandle) []entry {
+	nm := dir.nm
+	dirs := make([]entry, 0, len(dev)/2)
+	for i := range dev {
+		if d.ctx.Err() != nil {
+			break
 		}
 
-		// don't process entries we've already seen
-		if d.isEntrySeen(nm, fi) {
+		de := dev[i]
+		fp := d.join(nm, de.Name())
+		if d.exclude(fp, dir.root) {
 			continue
 		}
 
-		if d.Filter(fp, fi) {
-			continue
+		// readdir gives us the type bits for free (d_type on linux);
+		// we only lstat the entry if someone needs the rest.
+		var fi os.FileInfo
+		var err error
+		m := de.Type()
+		if d.statAll {
+			d.charge(1, 0)
+			fi, err = de.Info()
+			if err != nil {
+				d.error("lstat", fp, dir.root, err)
+				continue
+			}
+			m = fi.Mode()
+
+			// don't process entries we've already seen
+			dup := d.isDup(fp, fi)
+			if dup && d.isSingleFS(fp, fi) {
+				continue
+			}
+
+			if d.Filter(fp, fi) {
+				continue
+			}
+
+			if dir.ds != nil {
+				dir.ds.account(fi, dup)
+			}
 		}
 
+		e := entry{
+			nm:    fp,
+			root:  dir.root,
+			rel:   path.Join(dir.rel, de.Name()),
+			depth: dir.depth + 1,
+			up:    dir.up,
+			n:     dir.n,
+			ds:    dir.ds,
+			de:    de,
+		}
+		if len(dir.real) > 0 {
+			e.real = d.join(dir.real, de.Name())
+		}
 		switch {
 		case m.IsDir():
 			// don't descend if this directory is not on the same file system.
 			if d.singlefs(fp, fi) {
-				dirs = append(dirs, fp)
+				if h != nil {
+					h.child(&e, fi)
+				}
+				dirs = d.addDir(dirs, e)
 			}
 
 		case (m & os.ModeSymlink) > 0:
 			// we may have new info now. The symlink may point to file, dir or
 			// special.
-			dirs = d.doSymlink(fp, fi, dirs)
+			dirs = d.doSymlink(e, fi, dirs)
 
 		default:
-			d.output(fp, fi)
+			d.output(e, fi)
 		}
 	}
 
-	d.enq(dirs)
+	return dirs
+}
+
+// join a dir and a name to make a new path
+func (d *walkState) join(dir, nm string) string {
+	if j, ok := d.fsys.(joiner); ok {
+		return j.Join(dir, nm)
+	}
+
+	// hack to make joined paths not look like '//file'
+	if dir == "/" {
+		return "/" + nm
+	}
+
+	// we don't want to use filepath.Join() because it "cleans"
+	// the path (removes the leading .)
+	return fmt.Sprintf("%s/%s", dir, nm)
 }
 
 // Walk symlinks and don't process dirs/entries that we've already seen
 // This function returns true if 'nm' ends up being a directory that we must descend.
-func (d *walkState) doSymlink(nm string, fi os.FileInfo, dirs []string) []string {
+func (d *walkState) doSymlink(e entry, fi os.FileInfo, dirs []entry) []entry {
 	if !d.FollowSymlinks {
-		d.output(nm, fi)
+		if d.ReadLinks && (d.typ&os.ModeSymlink) > 0 {
+			if !d.readLink(&e) {
+				return dirs
+			}
+		}
+		d.output(e, fi)
 		return dirs
 	}
 
+	// the link itself; e.nm may be the resolved path below
+	lnk := e.nm
+
 	// process symlinks until we are done
-	newnm, err := filepath.EvalSymlinks(nm)
+	nm, err := d.evalSymlinks(e.path())
 	if err != nil {
-		d.error("symlink %s: %s", nm, err)
+		if errors.Is(err, fs.ErrNotExist) {
+			err = fmt.Errorf("%w: %w", ErrDanglingLink, err)
+		}
+		d.error("symlink", lnk, e.root, err)
 		return dirs
 	}
-	nm = newnm
+
+	if d.LogicalPaths {
+		d.charge(1, 0)
+		e.link, err = d.fsys.Readlink(e.path())
+		if err != nil {
+			d.error("readlink", e.nm, e.root, err)
+			return dirs
+		}
+		d.charge(0, len(e.link))
+		e.real = nm
+	} else {
+		e.nm = nm
+	}
 
 	// we know this is no longer a symlink
-	fi, err = os.Stat(nm)
+	d.charge(1, 0)
+	fi, err = d.fsys.Stat(nm)
 	if err != nil {
-		d.error("stat %s: %s", nm, err)
+		d.error("stat", lnk, e.root, err)
+		return dirs
+	}
+
+	// a symlink to one of our parent dirs will make us go around in circles
+	if fi.IsDir() && d.isAncestor(&e, fi) {
+		d.error("symlink", lnk, e.root, &SymlinkLoopError{Path: lnk, Chain: []string{lnk, nm}})
 		return dirs
 	}
 
@@ -528,37 +1264,66 @@ func (d *walkState) doSymlink(nm string, fi os.FileInfo, dirs []string) []string
 		case fi.Mode().IsDir():
 			// we only have to worry about mount points
 			if d.singlefs(nm, fi) {
-				dirs = append(dirs, nm)
+				dirs = d.addDir(dirs, e)
 			}
 		default:
-			d.output(nm, fi)
+			d.output(e, fi)
 		}
 	}
 
 	return dirs
 }
 
-// track this inode to detect loops; return true if we've seen it before
-// false otherwise.
-func (d *walkState) isEntrySeen(nm string, fi os.FileInfo) bool {
-	st, ok := fi.Sys().(*syscall.Stat_t)
-	if !ok {
-		return false
+// read the target of the symlink 'e' and mark it if it is dangling.
+// Return false if the caller wants us to skip this entry.
+func (d *walkState) readLink(e *entry) bool {
+	var err error
+
+	d.charge(1, 0)
+	if d.fdw != nil {
+		e.link, err = d.fdw.readlink(e)
+	} else {
+		e.link, err = d.fsys.Readlink(e.path())
+	}
+	if err != nil {
+		return d.error("readlink", e.nm, e.root, err) == ActionContinue
 	}
+	d.charge(1, len(e.link))
 
-	key := fmt.Sprintf("%d:%d:%d", st.Dev, st.Rdev, st.Ino)
-	x, ok := d.ino.LoadOrStore(key, st)
+	if d.fdw != nil {
+		_, err = d.fdw.stat(e)
+	} else {
+		_, err = d.fsys.Stat(e.path())
+	}
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			e.dangling = true
+		} else {
+			return d.error("stat", e.nm, e.root, err) == ActionContinue
+		}
+	}
+	return true
+}
+
+// return true if 'fi' is one of the dirs leading to 'e'
+func (d *walkState) isAncestor(e *entry, fi os.FileInfo) bool {
+	id, ok := d.fsys.FileID(fi)
 	if !ok {
 		return false
 	}
 
-	// This can't fail because we checked it above before storing in the
-	// sync.Map
-	xt := x.(*syscall.Stat_t)
-
-	//fmt.Printf("# %s: old ino: %d:%d:%d  <-> new ino: %d:%d:%d\n", nm, xt.Dev, xt.Rdev, xt.Ino, st.Dev, st.Rdev, st.Ino)
+	for p := e.up; p != nil; p = p.up {
+		if p.id == id {
+			return true
+		}
+	}
+	return false
+}
 
-	if xt.Dev != st.Dev || xt.Rdev != st.Rdev || xt.Ino != st.Ino {
+// track this inode to detect loops; return true if we've seen it before
+// false otherwise.
+func (d *walkState) isEntrySeen(nm string, fi os.FileInfo) bool {
+	if !d.isDup(nm, fi) {
 		return false
 	}
 
@@ -567,30 +1332,85 @@ func (d *walkState) isEntrySeen(nm string, fi os.FileInfo) bool {
 	return d.isSingleFS(nm, fi)
 }
 
+// track this inode and return true if we've seen it before
+func (d *walkState) isDup(nm string, fi os.FileInfo) bool {
+	id, ok := d.fsys.FileID(fi)
+	if !ok {
+		return false
+	}
+
+	_, ok = d.ino.LoadOrStore(id, nm)
+	return ok
+}
+
 // track this file for future mount points
 // We call this function once for each entry passed to Walk().
 func (d *walkState) trackFS(fi os.FileInfo, nm string) {
-	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
-		key := fmt.Sprintf("%d:%d", st.Dev, st.Rdev)
-		d.fs.Store(key, nm)
+	if id, ok := d.fsys.FileID(fi); ok {
+		d.fs.Store(id.Dev, nm)
 	}
 }
 
-// Return true if the inode is on the same file system as the command line args
+// Return true if the inode is on the same file system as the command line args.
+// File systems that don't expose device info are always treated as a single
+// file system.
 func (d *walkState) isSingleFS(nm string, fi os.FileInfo) bool {
-	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
-		key := fmt.Sprintf("%d:%d", st.Dev, st.Rdev)
-		if _, ok := d.fs.Load(key); ok {
-			return true
-		}
+	id, ok := d.fsys.FileID(fi)
+	if !ok {
+		return true
 	}
 
-	return false
+	_, ok = d.fs.Load(id.Dev)
+	return ok
+}
+
+// enq an error for the operation 'op' on 'nm' and return the caller's
+// choice of what to do next.
+func (d *walkState) error(op, nm, root string, err error) Action {
+	e := &Error{
+		Op:   op,
+		Path: nm,
+		Root: root,
+		Err:  err,
+	}
+
+	act := ActionContinue
+	if d.OnError != nil {
+		act = d.OnError(e)
+	}
+
+	switch act {
+	case ActionSkipDir:
+	case ActionAbort:
+		d.sendErr(e)
+		d.cancel()
+	default:
+		d.sendErr(e)
+	}
+	return act
 }
 
-// enq an error
-func (d *walkState) error(s string, args ...any) {
-	d.errch <- fmt.Errorf(s, args...)
+// enq an error unless we've been cancelled
+func (d *walkState) sendErr(err error) {
+	if d.resch != nil {
+		r := Result{Err: err}
+
+		var we *Error
+		if errors.As(err, &we) {
+			r.Path, r.Root = we.Path, we.Root
+		}
+
+		select {
+		case d.resch <- r:
+		case <-d.ctx.Done():
+		}
+		return
+	}
+
+	select {
+	case d.errch <- err:
+	case <-d.ctx.Done():
+	}
 }
 
 // EOF
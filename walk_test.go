@@ -3,6 +3,7 @@
 package walk
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/fs"
@@ -11,6 +12,7 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
 )
 
@@ -91,6 +93,28 @@ func newWalk(tx *test) (map[string]fs.FileInfo, error) {
 	return res, nil
 }
 
+// walk 'root' via All() and return the results and the errors. If 'exp'
+// is non-nil, we also report the entries that aren't in it and a count
+// that doesn't match. This doesn't assert; so any go-routine can call it.
+func allWalk(root string, opt *Options, exp map[string]fs.FileInfo) ([]Result, []error) {
+	var res []Result
+	var errs []error
+	for r, err := range All([]string{root}, opt) {
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, ok := exp[r.Path]; exp != nil && !ok {
+			errs = append(errs, fmt.Errorf("unexpected entry %s", r.Path))
+		}
+		res = append(res, r)
+	}
+	if exp != nil && len(res) != len(exp) {
+		errs = append(errs, fmt.Errorf("exp %d entries, saw %d", len(exp), len(res)))
+	}
+	return res, errs
+}
+
 func oldWalk(tx *test) (map[string]fs.FileInfo, error) {
 	var m os.FileMode
 
@@ -201,3 +225,475 @@ func TestWalk(t *testing.T) {
 		})
 	}
 }
+
+// make a synthetic tree under 'root' that is 'depth' levels deep with
+// 'width' files and dirs at each level
+func mkTree(t *testing.T, root string, depth, width int) {
+	assert := newAsserter(t)
+	for i := 0; i < width; i++ {
+		fn := filepath.Join(root, fmt.Sprintf("file-%d", i))
+		err := os.WriteFile(fn, []byte(fn), 0600)
+		assert(err == nil, "write %s: %s", fn, err)
+
+		if depth > 0 {
+			dn := filepath.Join(root, fmt.Sprintf("dir-%d", i))
+			err := os.Mkdir(dn, 0700)
+			assert(err == nil, "mkdir %s: %s", dn, err)
+			mkTree(t, dn, depth-1, width)
+		}
+	}
+}
+
+func TestWalkCancel(t *testing.T) {
+	assert := newAsserter(t)
+
+	root := t.TempDir()
+	mkTree(t, root, 4, 6)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	och, ech := WalkContext(ctx, []string{root}, &Options{Type: ALL})
+
+	// read one result and walk away
+	_, ok := <-och
+	assert(ok, "no results")
+	cancel()
+
+	// the channels must be closed in short order
+	for range och {
+	}
+
+	var errs []error
+	for e := range ech {
+		errs = append(errs, e)
+	}
+	err := errors.Join(errs...)
+	assert(errors.Is(err, context.Canceled), "expected cancellation; saw %v", err)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	err = WalkFuncContext(ctx, []string{root}, nil, func(r Result) error {
+		return nil
+	})
+	assert(errors.Is(err, context.Canceled), "walkfunc: expected cancellation; saw %v", err)
+}
+
+func TestWalkSkip(t *testing.T) {
+	assert := newAsserter(t)
+
+	root := t.TempDir()
+	mkTree(t, root, 3, 4)
+
+	// prune every "dir-1" subtree
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	err := WalkFunc([]string{root}, &Options{Type: ALL}, func(r Result) error {
+		if r.Stat.IsDir() && filepath.Base(r.Path) == "dir-1" {
+			return SkipDir
+		}
+		mu.Lock()
+		seen[r.Path] = true
+		mu.Unlock()
+		return nil
+	})
+	assert(err == nil, "walk: %s", err)
+	assert(len(seen) > 0, "walk: no entries")
+	for k := range seen {
+		assert(!strings.Contains(k, "/dir-1/"), "saw entry in pruned dir: %s", k)
+	}
+	assert(seen[filepath.Join(root, "dir-0", "dir-2", "file-3")], "missing entry")
+
+	// stop at the first match
+	var n int
+	err = WalkFunc([]string{root}, &Options{Type: FILE}, func(r Result) error {
+		mu.Lock()
+		n++
+		mu.Unlock()
+		return SkipAll
+	})
+	assert(err == nil, "skipall: %s", err)
+	assert(n < len(seen), "skipall: didn't stop early; saw %d entries", n)
+}
+
+func TestWalkDepth(t *testing.T) {
+	assert := newAsserter(t)
+
+	root := t.TempDir()
+	mkTree(t, root, 4, 2)
+
+	depth := func(p string) int {
+		if p == root {
+			return 0
+		}
+		return strings.Count(strings.TrimPrefix(p, root), "/")
+	}
+
+	tests := []struct {
+		min, max int
+	}{
+		{0, 0},
+		{0, 1},
+		{1, 2},
+		{2, 0},
+		{3, 3},
+	}
+
+	for _, tx := range tests {
+		exp, err := oldWalk(&test{root, ALL})
+		assert(err == nil, "oldwalk: %s", err)
+		for k := range exp {
+			if d := depth(k); d < tx.min || (tx.max > 0 && d > tx.max) {
+				delete(exp, k)
+			}
+		}
+
+		opt := &Options{
+			Type:     ALL,
+			MinDepth: tx.min,
+			MaxDepth: tx.max,
+		}
+		var n int
+		for r, err := range All([]string{root}, opt) {
+			assert(err == nil, "walk: %s", err)
+			_, ok := exp[r.Path]
+			assert(ok, "%d-%d: unexpected entry %s", tx.min, tx.max, r.Path)
+			n++
+		}
+		assert(n == len(exp), "%d-%d: exp %d entries, saw %d", tx.min, tx.max, len(exp), n)
+	}
+}
+
+func TestWalkBigDir(t *testing.T) {
+	assert := newAsserter(t)
+
+	// a dir that takes a few batches to read, with subdirs
+	// scattered across the batches.
+	root := t.TempDir()
+	n := 3*_ReadDirBatch + 7
+	for i := 0; i < n; i++ {
+		fn := filepath.Join(root, fmt.Sprintf("f-%d", i))
+		if i%500 == 0 {
+			err := os.Mkdir(fn, 0700)
+			assert(err == nil, "mkdir %s: %s", fn, err)
+			mkTree(t, fn, 1, 2)
+			continue
+		}
+		err := os.WriteFile(fn, nil, 0600)
+		assert(err == nil, "write %s: %s", fn, err)
+	}
+
+	exp, err := oldWalk(&test{root, ALL})
+	assert(err == nil, "oldwalk: %s", err)
+
+	seen := make(map[string]bool)
+	for r, err := range All([]string{root}, &Options{Type: ALL}) {
+		assert(err == nil, "walk: %s", err)
+		assert(!seen[r.Path], "dup entry %s", r.Path)
+		_, ok := exp[r.Path]
+		assert(ok, "unexpected entry %s", r.Path)
+		seen[r.Path] = true
+	}
+	assert(len(seen) == len(exp), "exp %d entries, saw %d", len(exp), len(seen))
+}
+
+func TestWalkGoroutines(t *testing.T) {
+	assert := newAsserter(t)
+
+	root := t.TempDir()
+	mkTree(t, root, 2, 12)
+
+	// a worker that is slow to read its dir lets its siblings pile up
+	// in the queue
+	base := runtime.NumGoroutine()
+	fsys := &busyFS{FileSystem: HostFS()}
+	opt := &Options{
+		Type:       DIR,
+		Workers:    4,
+		FileSystem: fsys,
+	}
+
+	var mu sync.Mutex
+	peak := 0
+	err := WalkFunc([]string{root}, opt, func(r Result) error {
+		mu.Lock()
+		peak = max(peak, runtime.NumGoroutine())
+		mu.Unlock()
+		return nil
+	})
+	assert(err == nil, "walk: %s", err)
+
+	// the workers and the go-routine waiting for them
+	assert(peak <= base+opt.Workers+2, "too many go-routines: %d, exp <= %d", peak, base+opt.Workers+2)
+}
+
+func TestWalkRelPath(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := t.TempDir()
+	r1 := filepath.Join(tmp, "r1")
+	r2 := filepath.Join(tmp, "r2")
+	for _, d := range []string{r1, r2} {
+		err := os.Mkdir(d, 0700)
+		assert(err == nil, "mkdir: %s", err)
+		mkTree(t, d, 2, 2)
+	}
+
+	err := os.Symlink(filepath.Join(r2, "dir-1"), filepath.Join(r1, "link"))
+	assert(err == nil, "symlink: %s", err)
+
+	opt := &Options{
+		Type:           ALL,
+		FollowSymlinks: true,
+	}
+
+	var n int
+	for r, err := range All([]string{r1, r2}, opt) {
+		assert(err == nil, "walk: %s", err)
+		assert(r.Root == r1 || r.Root == r2, "%s: wrong root %s", r.Path, r.Root)
+
+		if r.RelPath == "." {
+			assert(r.Depth == 0 && r.Path == r.Root, "%s: wrong root entry %+v", r.Path, r)
+			continue
+		}
+
+		n++
+		assert(r.Depth == strings.Count(r.RelPath, "/")+1, "%s: wrong depth %d", r.RelPath, r.Depth)
+		if r.RelPath == "link" || strings.HasPrefix(r.RelPath, "link/") {
+			assert(r.Root == r1, "%s: wrong root %s", r.Path, r.Root)
+			assert(strings.HasPrefix(r.Path, r2), "%s: link not resolved", r.Path)
+		} else {
+			assert(r.Path == filepath.Join(r.Root, r.RelPath), "%s: wrong relpath %s", r.Path, r.RelPath)
+		}
+	}
+	assert(n > 0, "no entries")
+}
+
+func TestWalkLogicalPaths(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := t.TempDir()
+	root := filepath.Join(tmp, "root")
+	targ := filepath.Join(tmp, "targ")
+	for _, d := range []string{root, targ} {
+		err := os.Mkdir(d, 0700)
+		assert(err == nil, "mkdir: %s", err)
+		mkTree(t, d, 1, 2)
+	}
+
+	err := os.Symlink("../targ", filepath.Join(root, "link"))
+	assert(err == nil, "symlink: %s", err)
+	err = os.Symlink("../targ/file-1", filepath.Join(root, "flink"))
+	assert(err == nil, "symlink: %s", err)
+
+	// EvalSymlinks resolves the tmpdir itself
+	rtarg, err := filepath.EvalSymlinks(targ)
+	assert(err == nil, "eval: %s", err)
+
+	opt := &Options{
+		Type:           ALL,
+		FollowSymlinks: true,
+		LogicalPaths:   true,
+	}
+
+	seen := make(map[string]Result)
+	for r, err := range All([]string{root}, opt) {
+		assert(err == nil, "walk: %s", err)
+		assert(strings.HasPrefix(r.Path, root), "%s: escaped the root", r.Path)
+		seen[r.Path] = r
+	}
+
+	r, ok := seen[filepath.Join(root, "link")]
+	assert(ok, "missing link")
+	assert(r.Stat.IsDir(), "link: not a dir")
+	assert(r.LinkTarget == "../targ", "link: wrong target %s", r.LinkTarget)
+	assert(r.Resolved == rtarg, "link: wrong resolved path %s", r.Resolved)
+
+	r, ok = seen[filepath.Join(root, "link", "dir-0", "file-1")]
+	assert(ok, "missing link/dir-0/file-1")
+	assert(r.Resolved == filepath.Join(rtarg, "dir-0", "file-1"), "wrong resolved path %s", r.Resolved)
+	assert(r.LinkTarget == "", "wrong link target %s", r.LinkTarget)
+
+	r, ok = seen[filepath.Join(root, "flink")]
+	assert(ok, "missing flink")
+	assert(r.Stat.Mode().IsRegular(), "flink: not a file")
+	assert(r.LinkTarget == "../targ/file-1", "flink: wrong target %s", r.LinkTarget)
+
+	r, ok = seen[filepath.Join(root, "file-0")]
+	assert(ok, "missing file-0")
+	assert(r.Resolved == "", "file-0: wrong resolved path %s", r.Resolved)
+}
+
+func TestWalkReadLinks(t *testing.T) {
+	assert := newAsserter(t)
+
+	root := t.TempDir()
+	mkTree(t, root, 1, 2)
+
+	links := map[string]string{
+		"good":  "file-0",
+		"dgood": "dir-1",
+		"bad":   "nonexistent",
+		"bad2":  "dir-0/nonexistent",
+	}
+	for k, v := range links {
+		err := os.Symlink(v, filepath.Join(root, k))
+		assert(err == nil, "symlink: %s", err)
+	}
+
+	opt := &Options{
+		Type:      SYMLINK,
+		ReadLinks: true,
+	}
+
+	var n int
+	for r, err := range All([]string{root}, opt) {
+		assert(err == nil, "walk: %s", err)
+
+		nm := filepath.Base(r.Path)
+		targ, ok := links[nm]
+		assert(ok, "unexpected entry %s", r.Path)
+		assert(r.LinkTarget == targ, "%s: wrong target %s", nm, r.LinkTarget)
+		assert(r.Dangling == strings.HasPrefix(nm, "bad"), "%s: wrong dangling state", nm)
+		n++
+	}
+	assert(n == len(links), "exp %d links, saw %d", len(links), n)
+}
+
+func TestWalkSymlinkLoops(t *testing.T) {
+	assert := newAsserter(t)
+
+	root := t.TempDir()
+	mkTree(t, root, 2, 2)
+
+	links := [][2]string{
+		{"..", "dir-0/up"},
+		{"l2", "l1"},
+		{"l1", "l2"},
+		{"nonexistent", "bad"},
+		{"c2", "c1"},
+		{"c3", "c2"},
+		{"file-0", "c3"},
+
+		// x goes through 'ld' twice; but it isn't a loop
+		{"dir-1", "ld"},
+		{"../ld/file-0", "dir-1/y2"},
+		{"ld/y2", "x"},
+	}
+	for _, v := range links {
+		err := os.Symlink(v[0], filepath.Join(root, v[1]))
+		assert(err == nil, "symlink: %s", err)
+	}
+
+	walk := func(opt *Options) (map[string]bool, []error) {
+		res, errs := allWalk(root, opt, nil)
+		seen := make(map[string]bool)
+		for _, r := range res {
+			seen[r.RelPath] = true
+		}
+		return seen, errs
+	}
+
+	// the chain starts at the link and follows it to where the loop closes
+	checkChain := func(le *SymlinkLoopError) {
+		assert(len(le.Chain) >= 2 && le.Chain[0] == le.Path, "bad chain: %s", le)
+
+		switch filepath.Base(le.Path) {
+		case "up":
+			assert(len(le.Chain) == 2 && le.Chain[1] == root, "bad chain: %s", le)
+		case "l1", "l2":
+			for i, nm := range le.Chain[1:] {
+				assert(nm != le.Chain[i], "bad chain: %s", le)
+				assert(filepath.Dir(nm) == root, "bad chain: %s", le)
+			}
+		default:
+			t.Fatalf("unexpected loop: %s", le)
+		}
+	}
+
+	for _, logical := range []bool{false, true} {
+		opt := &Options{
+			Type:           ALL,
+			FollowSymlinks: true,
+			LogicalPaths:   logical,
+		}
+
+		seen, errs := walk(opt)
+		assert(seen["c1"], "missing c1")
+		assert(seen["dir-1/file-1"], "missing dir-1/file-1")
+		assert(seen["x"], "missing x")
+
+		var loops, dangling int
+		for _, err := range errs {
+			var le *SymlinkLoopError
+			switch {
+			case errors.As(err, &le):
+				var we *Error
+				assert(errors.As(err, &we) && we.Path == le.Path, "wrong path: %s", err)
+				assert(strings.Count(err.Error(), "symlink ") == 1, "repeated path: %s", err)
+				checkChain(le)
+				loops++
+			case errors.Is(err, ErrDanglingLink):
+				dangling++
+			default:
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+		assert(loops == 3, "exp 3 loops, saw %d: %v", loops, errs)
+		assert(dangling == 1, "exp 1 dangling, saw %d: %v", dangling, errs)
+	}
+
+	// we can't get to c1 in 2 links
+	opt := &Options{
+		Type:           ALL,
+		FollowSymlinks: true,
+		MaxSymlinks:    2,
+	}
+	seen, errs := walk(opt)
+	assert(!seen["c1"], "found c1")
+	assert(seen["c2"], "missing c2")
+
+	var le *SymlinkLoopError
+	var found bool
+	for _, err := range errs {
+		if errors.As(err, &le) && strings.HasSuffix(le.Path, "c1") {
+			found = true
+			assert(errors.Is(err, syscall.ELOOP), "not ELOOP: %s", err)
+		}
+	}
+	assert(found, "missing loop error for c1: %v", errs)
+}
+
+func TestWalkErrorsInResult(t *testing.T) {
+	assert := newAsserter(t)
+
+	root := t.TempDir()
+	mkTree(t, root, 2, 6)
+
+	// fail every dir two levels below root
+	bad := make(map[string]error)
+	for i := 0; i < 6; i++ {
+		for j := 0; j < 6; j++ {
+			nm := filepath.Join(root, fmt.Sprintf("dir-%d", i), fmt.Sprintf("dir-%d", j))
+			bad[nm] = syscall.EACCES
+		}
+	}
+
+	opt := &Options{
+		Type:           ALL,
+		FileSystem:     &faultFS{HostFS(), bad},
+		ErrorsInResult: true,
+	}
+
+	// we only service the result chan
+	och, _ := Walk([]string{root}, opt)
+
+	var nerr int
+	for r := range och {
+		if r.Err != nil {
+			_, ok := bad[r.Path]
+			assert(ok, "unexpected error: %s", r.Err)
+			assert(r.Root == root, "%s: wrong root %s", r.Path, r.Root)
+			nerr++
+		}
+	}
+	assert(nerr == len(bad), "exp %d errors, saw %d", len(bad), nerr)
+}
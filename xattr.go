@@ -28,6 +28,15 @@ func (x Xattr) String() string {
 	return s.String()
 }
 
+// return the total size of the names and values in 'x'
+func (x Xattr) size() int {
+	n := 0
+	for k, v := range x {
+		n += len(k) + len(v)
+	}
+	return n
+}
+
 // NewXattr returns the extended attributes of file 'fn'
 func GetXattr(fn string) (Xattr, error) {
 	return getxattr(fn)